@@ -1,57 +1,680 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 )
 
+const (
+	modePoll   = "poll"
+	modeScrape = "scrape"
+)
+
+// Flags of the exporter, kept apart from flags that packages register globally
+var flags = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
 var (
-	exporterAddress          = flag.String("exporter.address", ":55555", "Address of the exporter")
-	exporterEndpoint         = flag.String("exporter.endpoint", "/metrics", "Path where metrics are served")
-	logLevel                 = flag.String("log.level", "info", "Log level")
-	mesosMasters             = flag.String("mesos.masters", "http://localhost:5050", "A list of Mesos masters separated by commas")
-	mesosMasterQueryInterval = flag.Duration("mesos.master-pollinterval", 15*time.Second, "Interval to poll the Mesos master leader for new slaves")
-	mesosSlaveQueryInterval  = flag.Duration("mesos.slave-pollinterval", 15*time.Second, "Interval to poll a Mesos slave for stats of tasks")
+	configFile                  = flags.String("config.file", "", "YAML file with settings for all other flags - reloaded on SIGHUP or a POST to /-/reload, flags and environment variables take precedence")
+	dcosServiceAccountFile      = flags.String("dcos.service-account-file", "", "File with the uid and private key of a DC/OS service account to authenticate against Mesos masters and slaves with")
+	exporterAddress             = flags.String("exporter.address", ":55555", "Address of the exporter")
+	exporterEndpoint            = flags.String("exporter.endpoint", "/metrics", "Path where metrics are served")
+	exporterMode                = flags.String("exporter.mode", modePoll, "How metrics are gathered: 'poll' queries Mesos in the background, 'scrape' queries Mesos whenever metrics are requested")
+	exporterScrapeTimeout       = flags.Duration("exporter.scrape-timeout", 10*time.Second, "Time to wait for Mesos when metrics are requested in 'scrape' mode")
+	exporterShutdownTimeout     = flags.Duration("exporter.shutdown-timeout", 5*time.Second, "Time to wait for scrapes in progress and pollers when the exporter is stopped")
+	filterExecutorIdExclude     = flags.String("filter.executor-id-exclude", "", "Regular expression of IDs of executors whose tasks are not exported")
+	filterExecutorIdInclude     = flags.String("filter.executor-id-include", "", "Regular expression of IDs of executors whose tasks are exported - all if empty")
+	filterFrameworkIdExclude    = flags.String("filter.framework-id-exclude", "", "Regular expression of IDs of frameworks that are not exported")
+	filterFrameworkIdInclude    = flags.String("filter.framework-id-include", "", "Regular expression of IDs of frameworks that are exported - all if empty")
+	filterFrameworkNameExclude  = flags.String("filter.framework-name-exclude", "", "Regular expression of names of frameworks that are not exported")
+	filterFrameworkNameInclude  = flags.String("filter.framework-name-include", "", "Regular expression of names of frameworks that are exported - all if empty")
+	filterRoleExclude           = flags.String("filter.role-exclude", "", "Regular expression of roles of frameworks that are not exported")
+	filterRoleInclude           = flags.String("filter.role-include", "", "Regular expression of roles of frameworks that are exported - all if empty")
+	filterSlaveAttributeExclude = flags.String("filter.slave-attribute-exclude", "", "Regular expression of slave attributes like 'rack:r1' - slaves with a matching attribute are not queried")
+	filterSlaveAttributeInclude = flags.String("filter.slave-attribute-include", "", "Regular expression of slave attributes like 'rack:r1' - only slaves with a matching attribute are queried, all if empty")
+	filterTaskNameExclude       = flags.String("filter.task-name-exclude", "", "Regular expression of names of tasks that are not exported")
+	filterTaskNameInclude       = flags.String("filter.task-name-include", "", "Regular expression of names of tasks that are exported - all if empty")
+	logLevel                    = flags.String("log.level", "info", "Log level")
+	mesosApiVersion             = flags.String("mesos.api-version", apiVersionAuto, "API used to query Mesos: 'v0' for the legacy JSON endpoints, 'v1' for the v1 Operator API or 'auto' to choose based on the version of Mesos")
+	mesosCredentialFile         = flags.String("mesos.credential-file", "", "File with a principal and secret to authenticate against Mesos masters and slaves with HTTP Basic authentication")
+	mesosFrameworkExpiry        = flags.Duration("mesos.framework-expiry", 5*time.Minute, "Time to keep frameworks that the Mesos master does not report anymore")
+	mesosIdleConnTimeout        = flags.Duration("mesos.idle-conn-timeout", 90*time.Second, "Time after which idle keep-alive connections to Mesos masters and slaves are closed - never if 0")
+	mesosMasterEndpoints        = flags.String("mesos.master-endpoints", masterEndpointsState, "Endpoints the state of the Mesos master leader is read from with the v0 API: 'state' for /master/state or 'split' for the lighter /master/slaves, /master/frameworks and /master/tasks")
+	mesosMasterHttps            = flags.Bool("mesos.master-https", false, "Use HTTPS to query Mesos masters discovered in ZooKeeper - URLs in -mesos.masters carry their own scheme")
+	mesosMasters                = flags.String("mesos.masters", "http://localhost:5050", "A list of Mesos masters separated by commas or a ZooKeeper URL like 'zk://host1:2181,host2:2181/mesos'")
+	mesosMasterHealthInterval   = flags.Duration("mesos.master-health-interval", 30*time.Second, "Interval to check the health of every Mesos master in -mesos.masters or ZooKeeper - disabled if 0")
+	mesosMasterSubscribe        = flags.Bool("mesos.master-subscribe", false, "Follow the event stream of the Mesos master leader to count task state transitions and discover slaves immediately - requires Mesos 1.1 or later")
+	mesosMasterQueryInterval    = flags.Duration("mesos.master-pollinterval", 15*time.Second, "Interval to poll the Mesos master leader for new slaves")
+	mesosMasterRequestTimeout   = flags.Duration("mesos.master-request-timeout", 30*time.Second, "Time to wait for a single request for the state of a Mesos master - unlimited if 0")
+	mesosMasterTasksPageSize    = flags.Int("mesos.master-tasks-page-size", 1000, "Number of tasks requested from /master/tasks at a time with -mesos.master-endpoints=split")
+	mesosMaxIdleConns           = flags.Int("mesos.max-idle-conns", 100, "Maximum number of idle keep-alive connections to all Mesos masters and slaves - unlimited if 0")
+	mesosMaxIdleConnsPerHost    = flags.Int("mesos.max-idle-conns-per-host", 2, "Maximum number of idle keep-alive connections to each Mesos master or slave")
+	mesosMaxResponseSize        = flags.Int64("mesos.max-response-size", 0, "Maximum size in bytes of a single response of a Mesos master or slave - unlimited if 0")
+	mesosSlaveAttributes        = flags.String("mesos.slave-attributes", "", "Attributes of Mesos slaves to add as labels to task and slave metrics, separated by commas")
+	mesosSlaveConcurrency       = flags.Int("mesos.slave-concurrency", 50, "Maximum number of Mesos slaves that are queried at the same time")
+	mesosSlaveUrl               = flags.String("mesos.slave-url", slaveUrlDirect, "How to reach Mesos slaves: 'direct' at the address in their PID, 'master' through the /slave/<id> proxy of the master leader or a URL template like 'https://router/agent/{{.ID}}'")
+	mesosSlaveHttps             = flags.Bool("mesos.slave-https", false, "Use HTTPS to query Mesos slaves")
+	mesosSlavePidLabel          = flags.Bool("mesos.slave-pid-label", true, "Label task and slave metrics with the PID of the slave in addition to its ID (agent_id) - disable to keep series when a slave restarts on another port")
+	mesosSlaveQueryInterval     = flags.Duration("mesos.slave-pollinterval", 15*time.Second, "Interval to poll a Mesos slave for stats of tasks")
+	mesosSlavePollTimeout       = flags.Duration("mesos.slave-poll-timeout", 0, "Time a poll of a Mesos slave may take with all of its requests - -mesos.slave-pollinterval if 0")
+	mesosSlaveRequestTimeout    = flags.Duration("mesos.slave-request-timeout", 10*time.Second, "Time to wait for a single request to a Mesos slave - unlimited if 0")
+	mesosSlaveFailureLimit      = flags.Int("mesos.slave-failure-threshold", 3, "Number of consecutive failed polls of a Mesos slave before its poller is restarted")
+	mesosSlaveBackoff           = flags.Duration("mesos.slave-restart-backoff", 1*time.Second, "Initial delay before a failed slave poller is restarted")
+	mesosSlaveBackoffMax        = flags.Duration("mesos.slave-restart-backoff-max", 5*time.Minute, "Maximum delay before a failed slave poller is restarted")
+	mesosTaskLabels             = flags.String("mesos.task-labels", "", "Labels of Mesos tasks to add as labels to task metrics, separated by commas")
+	mesosTaskLimit              = flags.Int("mesos.task-limit", 0, "Maximum number of tasks whose metrics are exported - unlimited if 0")
+	mesosTaskLimitOverflow      = flags.String("mesos.task-limit-overflow", overflowDrop, "What happens to tasks over -mesos.task-limit or -mesos.task-limit-per-framework: 'drop' their metrics or 'aggregate' them into one series per framework with executor_id, task and task labels set to \"other\"")
+	mesosTaskLimitPerFramework  = flags.Int("mesos.task-limit-per-framework", 0, "Maximum number of tasks per framework whose metrics are exported - unlimited if 0")
+	sdEndpoint                  = flags.String("sd.endpoint", "", "Path where ports of running tasks are served for Prometheus' http_sd_configs - disabled if empty")
+	sdFile                      = flags.String("sd.file", "", "File to write ports of running tasks to for Prometheus' file_sd_configs - disabled if empty")
+	tlsCaFile                   = flags.String("tls.ca-file", "", "File with CA certificates to verify Mesos masters and slaves with instead of the system's CAs")
+	tlsCertFile                 = flags.String("tls.cert-file", "", "File with a client certificate to present to Mesos masters and slaves")
+	tlsInsecureSkipVerify       = flags.Bool("tls.insecure-skip-verify", false, "Do not verify certificates of Mesos masters and slaves")
+	tlsKeyFile                  = flags.String("tls.key-file", "", "File with the key of the client certificate")
 )
 
 type Config struct {
-	ExporterAddress          string
-	ExporterEndpoint         string
-	LogLevel                 log.Level
-	MesosMasters             []*url.URL
-	MesosMasterQueryInterval time.Duration
-	MesosSlaveQueryInterval  time.Duration
+	DcosServiceAccountFile    string
+	ExporterAddress           string
+	ExporterEndpoint          string
+	ExporterMode              string
+	ExporterScrapeTimeout     time.Duration
+	ExporterShutdownTimeout   time.Duration
+	Filters                   *itemFilters
+	LogLevel                  log.Level
+	MesosApiVersion           string
+	MesosCredentialFile       string
+	MesosFrameworkExpiry      time.Duration
+	MesosIdleConnTimeout      time.Duration
+	MesosMaxIdleConns         int
+	MesosMaxIdleConnsPerHost  int
+	MesosMaxResponseSize      int64
+	MesosMasterEndpoints      string
+	MesosMasters              []*url.URL
+	MesosMasterHealthInterval time.Duration
+	MesosMasterScheme         string
+	MesosZkPath               string
+	MesosZkServers            []string
+	MesosMasterQueryInterval  time.Duration
+	MesosMasterRequestTimeout time.Duration
+	MesosMasterSubscribe      bool
+	MesosMasterTasksPageSize  int
+	MesosSlaveAttributes      []string
+	MesosSlaveAttributeLabels []string
+	MesosSlaveConcurrency     int
+	MesosSlavePidLabel        bool
+	MesosSlavePollTimeout     time.Duration
+	MesosSlaveQueryInterval   time.Duration
+	MesosSlaveRequestTimeout  time.Duration
+	MesosSlaveScheme          string
+	MesosSlaveUrl             string
+	MesosSlaveUrlTemplate     *template.Template
+	MesosSlaveFailureLimit    int
+	MesosSlaveBackoff         time.Duration
+	MesosSlaveBackoffMax      time.Duration
+	MesosTaskLabels           []string
+	MesosTaskLabelNames       []string
+	MesosTaskLimit            int
+	MesosTaskLimitOverflow    string
+	MesosFrameworkTaskLimit   int
+	SdEndpoint                string
+	SdFile                    string
+	TlsCaFile                 string
+	TlsCertFile               string
+	TlsInsecureSkipVerify     bool
+	TlsKeyFile                string
+
+	mutex sync.RWMutex
+	// Values of the flags the configuration was built from
+	settings map[string]string
+}
+
+// Settings that are applied to the running pollers on a reload. All other settings
+// require a restart.
+var reloadableSettings = map[string]struct{}{
+	"mesos.master-health-interval":    {},
+	"mesos.master-pollinterval":       {},
+	"mesos.master-request-timeout":    {},
+	"mesos.masters":                   {},
+	"mesos.max-response-size":         {},
+	"mesos.slave-failure-threshold":   {},
+	"mesos.slave-poll-timeout":        {},
+	"mesos.slave-pollinterval":        {},
+	"mesos.slave-request-timeout":     {},
+	"mesos.slave-restart-backoff":     {},
+	"mesos.slave-restart-backoff-max": {},
+	"mesos.task-limit":                {},
+	"mesos.task-limit-overflow":       {},
+	"mesos.task-limit-per-framework":  {},
 }
 
+// Flags given on the command line. They take precedence over the environment and
+// the config file.
+var commandLine = make(map[string]string)
+
 func newConfig() *Config {
-	flag.Parse()
+	flags.Parse(os.Args[1:])
+
+	flags.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = f.Value.String()
+	})
+
+	conf, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+
+	return conf
+}
+
+// Sets every flag from its default, the config file, its environment variable and
+// the command line - in increasing order of precedence - and builds a configuration
+// from the result.
+func loadConfig() (*Config, error) {
+	settings := make(map[string]string)
+
+	flags.VisitAll(func(f *flag.Flag) {
+		settings[f.Name] = f.DefValue
+	})
+
+	path, ok := commandLine["config.file"]
+	if ok == false {
+		path = os.Getenv(envName("config.file"))
+	}
+
+	if path != "" {
+		fileSettings, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, value := range fileSettings {
+			settings[name] = value
+		}
+	}
+
+	for name := range settings {
+		if value, ok := os.LookupEnv(envName(name)); ok {
+			settings[name] = value
+		}
+	}
+
+	for name, value := range commandLine {
+		settings[name] = value
+	}
+
+	for name, value := range settings {
+		err := flags.Set(name, value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value '%s' of '%s': %s", value, name, err)
+		}
+	}
+
+	return buildConfig(settings)
+}
+
+// Reads a YAML file with sections named after the prefix of the flags:
+//
+//	mesos:
+//	  masters: [http://master1:5050, http://master2:5050]
+//	  slave-pollinterval: 30s
+//
+// Lists are joined with commas.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+
+	err = yaml.Unmarshal(data, &values)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse config file '%s': %s", path, err)
+	}
+
+	settings := make(map[string]string)
+
+	for key, value := range values {
+		flattenSetting(key, value, settings)
+	}
+
+	for name := range settings {
+		if name == "config.file" || flags.Lookup(name) == nil {
+			return nil, fmt.Errorf("Unknown setting '%s' in config file '%s'", name, path)
+		}
+	}
+
+	return settings, nil
+}
+
+func flattenSetting(name string, value interface{}, settings map[string]string) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for key, item := range v {
+			flattenSetting(fmt.Sprintf("%s.%v", name, key), item, settings)
+		}
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+
+		settings[name] = strings.Join(items, ",")
+	case nil:
+		settings[name] = ""
+	default:
+		settings[name] = fmt.Sprint(v)
+	}
+}
+
+// Name of the environment variable of a flag, e.g. MESOS_SLAVE_POLLINTERVAL for
+// -mesos.slave-pollinterval.
+func envName(flagName string) string {
+	return strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flagName))
+}
+
+// Copies the reloadable settings of a new configuration. Returns the names of the
+// changed settings that require a restart - they keep their current value.
+func (c *Config) apply(other *Config) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.settings == nil {
+		c.settings = make(map[string]string)
+	}
+
+	restart := []string{}
+
+	for name, value := range other.settings {
+		if c.settings[name] == value {
+			continue
+		}
+
+		if _, ok := reloadableSettings[name]; ok == false || c.reloadable(name, other) == false {
+			restart = append(restart, name)
+			continue
+		}
+
+		c.settings[name] = value
+	}
+
+	sort.Strings(restart)
+
+	c.MesosMasterQueryInterval = other.MesosMasterQueryInterval
+	c.MesosMasterRequestTimeout = other.MesosMasterRequestTimeout
+	c.MesosMaxResponseSize = other.MesosMaxResponseSize
+	c.MesosSlaveQueryInterval = other.MesosSlaveQueryInterval
+	c.MesosSlavePollTimeout = other.MesosSlavePollTimeout
+	c.MesosSlaveRequestTimeout = other.MesosSlaveRequestTimeout
+	c.MesosSlaveFailureLimit = other.MesosSlaveFailureLimit
+	c.MesosSlaveBackoff = other.MesosSlaveBackoff
+	c.MesosSlaveBackoffMax = other.MesosSlaveBackoffMax
+	c.MesosTaskLimit = other.MesosTaskLimit
+	c.MesosTaskLimitOverflow = other.MesosTaskLimitOverflow
+	c.MesosFrameworkTaskLimit = other.MesosFrameworkTaskLimit
+
+	if c.reloadable("mesos.masters", other) {
+		c.MesosMasters = other.MesosMasters
+	}
+
+	if c.reloadable("mesos.master-health-interval", other) {
+		c.MesosMasterHealthInterval = other.MesosMasterHealthInterval
+	}
+
+	return restart
+}
+
+// Masters discovered in ZooKeeper can't be swapped for a static list or vice versa
+// and the health checks can't be turned on or off without a restart.
+func (c *Config) reloadable(name string, other *Config) bool {
+	switch name {
+	case "mesos.masters":
+		return len(c.MesosZkServers) == 0 && len(other.MesosZkServers) == 0
+	case "mesos.master-health-interval":
+		return (c.MesosMasterHealthInterval > 0) == (other.MesosMasterHealthInterval > 0)
+	}
+
+	return true
+}
+
+func (c *Config) masters() []*url.URL {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.MesosMasters
+}
+
+func (c *Config) masterHealthInterval() time.Duration {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.MesosMasterHealthInterval
+}
+
+func (c *Config) masterQueryInterval() time.Duration {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.MesosMasterQueryInterval
+}
+
+// Time to wait for a single request for the state of a master - unlimited if 0.
+func (c *Config) masterRequestTimeout() time.Duration {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.MesosMasterRequestTimeout
+}
+
+func (c *Config) slaveQueryInterval() time.Duration {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.MesosSlaveQueryInterval
+}
+
+func (c *Config) slaveFailureLimit() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 
+	return c.MesosSlaveFailureLimit
+}
+
+// Maximum size of a single response in bytes - unlimited if 0.
+func (c *Config) maxResponseSize() int64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.MesosMaxResponseSize
+}
+
+// Time to wait for a single request to a slave and for a whole poll of a slave.
+func (c *Config) slaveTimeouts() (time.Duration, time.Duration) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.MesosSlavePollTimeout > 0 {
+		return c.MesosSlaveRequestTimeout, c.MesosSlavePollTimeout
+	}
+
+	return c.MesosSlaveRequestTimeout, c.MesosSlaveQueryInterval
+}
+
+// Initial and maximum delay before a failed slave poller is restarted.
+func (c *Config) slaveBackoff() (time.Duration, time.Duration) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.MesosSlaveBackoff, c.MesosSlaveBackoffMax
+}
+
+// Maximum number of exported tasks in total and per framework and what happens to
+// tasks over the limit.
+func (c *Config) taskLimit() (int, int, string) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.MesosTaskLimit, c.MesosFrameworkTaskLimit, c.MesosTaskLimitOverflow
+}
+
+// Builds a configuration from the current values of the flags.
+func buildConfig(settings map[string]string) (*Config, error) {
 	logLevel, err := log.ParseLevel(*logLevel)
 	if err != nil {
 		log.Errorf("Invalid log level '%s' - defaulting to INFO", logLevel)
 		logLevel = log.InfoLevel
 	}
 
+	if *exporterMode != modePoll && *exporterMode != modeScrape {
+		return nil, fmt.Errorf("Invalid mode '%s' - must be one of '%s' or '%s'", *exporterMode, modePoll, modeScrape)
+	}
+
+	if *mesosApiVersion != apiVersionAuto && *mesosApiVersion != apiVersionV0 && *mesosApiVersion != apiVersionV1 {
+		return nil, fmt.Errorf("Invalid API version '%s' - must be one of '%s', '%s' or '%s'", *mesosApiVersion, apiVersionAuto, apiVersionV0, apiVersionV1)
+	}
+
+	if *mesosMasterSubscribe && *mesosApiVersion == apiVersionV0 {
+		return nil, errors.New("Subscribing to events of the Mesos master requires the v1 Operator API")
+	}
+
+	if *mesosMasterEndpoints != masterEndpointsState && *mesosMasterEndpoints != masterEndpointsSplit {
+		return nil, fmt.Errorf("Invalid master endpoints '%s' - must be one of '%s' or '%s'", *mesosMasterEndpoints, masterEndpointsState, masterEndpointsSplit)
+	}
+
+	if *mesosMasterEndpoints == masterEndpointsSplit && *mesosApiVersion == apiVersionV1 {
+		return nil, errors.New("Reading the state of the Mesos master from split endpoints requires the v0 API")
+	}
+
+	if *mesosMasterTasksPageSize < 1 {
+		return nil, fmt.Errorf("Invalid page size of tasks '%d' - must be at least 1", *mesosMasterTasksPageSize)
+	}
+
+	if *mesosCredentialFile != "" && *dcosServiceAccountFile != "" {
+		return nil, errors.New("Only one of a Mesos credential file and a DC/OS service account can be used")
+	}
+
+	slaveUrlTemplate, err := parseSlaveUrl(*mesosSlaveUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid slave URL '%s': %s", *mesosSlaveUrl, err)
+	}
+
+	failureLimit := *mesosSlaveFailureLimit
+	if failureLimit < 1 {
+		log.Errorf("Invalid slave failure threshold '%d' - defaulting to 1", failureLimit)
+		failureLimit = 1
+	}
+
+	slaveAttributes := splitList(*mesosSlaveAttributes)
+
+	slaveAttributeLabels, err := attributeLabelNames(slaveAttributes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid slave attributes: %s", err)
+	}
+
+	taskLabels := splitList(*mesosTaskLabels)
+
+	labelNames, err := mesosLabelNames(taskLabels, slaveAttributeLabels)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid task labels: %s", err)
+	}
+
+	if *mesosTaskLimit < 0 || *mesosTaskLimitPerFramework < 0 {
+		return nil, errors.New("Task limits must not be negative")
+	}
+
+	if *mesosTaskLimitOverflow != overflowDrop && *mesosTaskLimitOverflow != overflowAggregate {
+		return nil, fmt.Errorf("Invalid task limit overflow '%s' - must be one of '%s' or '%s'", *mesosTaskLimitOverflow, overflowDrop, overflowAggregate)
+	}
+
+	if *mesosSlaveConcurrency < 1 {
+		return nil, fmt.Errorf("Invalid slave concurrency '%d' - must be at least 1", *mesosSlaveConcurrency)
+	}
+
+	if *mesosMasterRequestTimeout < 0 || *mesosSlavePollTimeout < 0 || *mesosSlaveRequestTimeout < 0 || *mesosIdleConnTimeout < 0 {
+		return nil, errors.New("Timeouts must not be negative")
+	}
+
+	if *mesosMaxIdleConns < 0 || *mesosMaxIdleConnsPerHost < 0 {
+		return nil, errors.New("Limits of idle connections must not be negative")
+	}
+
+	if *mesosMaxResponseSize < 0 {
+		return nil, errors.New("Maximum response size must not be negative")
+	}
+
+	filterRules := make(map[string]filterRule)
+
+	for name, exprs := range map[string][2]string{
+		"executor-id":     {*filterExecutorIdInclude, *filterExecutorIdExclude},
+		"framework-id":    {*filterFrameworkIdInclude, *filterFrameworkIdExclude},
+		"framework-name":  {*filterFrameworkNameInclude, *filterFrameworkNameExclude},
+		"role":            {*filterRoleInclude, *filterRoleExclude},
+		"slave-attribute": {*filterSlaveAttributeInclude, *filterSlaveAttributeExclude},
+		"task-name":       {*filterTaskNameInclude, *filterTaskNameExclude},
+	} {
+		rule, err := newFilterRule(exprs[0], exprs[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid filter of %s: %s", name, err)
+		}
+
+		filterRules[name] = rule
+	}
+
 	masterUrls := []*url.URL{}
+	zkPath := ""
+	zkServers := []string{}
 
-	for _, rawUrl := range strings.Split(*mesosMasters, ",") {
-		masterUrl, err := url.Parse(rawUrl)
+	if strings.HasPrefix(*mesosMasters, "zk://") {
+		zkServers, zkPath, err = parseZkUrl(*mesosMasters)
 		if err != nil {
-			log.Fatalf("Unable to parse URL '%s': '%s'", rawUrl, err)
+			return nil, fmt.Errorf("Unable to parse ZooKeeper URL '%s': '%s'", *mesosMasters, err)
 		}
+	} else {
+		for _, rawUrl := range strings.Split(*mesosMasters, ",") {
+			masterUrl, err := url.Parse(rawUrl)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse URL '%s': '%s'", rawUrl, err)
+			}
 
-		masterUrls = append(masterUrls, masterUrl)
+			masterUrls = append(masterUrls, masterUrl)
+		}
 	}
 
 	return &Config{
-		ExporterAddress:          *exporterAddress,
-		ExporterEndpoint:         *exporterEndpoint,
-		LogLevel:                 logLevel,
-		MesosMasters:             masterUrls,
-		MesosMasterQueryInterval: *mesosMasterQueryInterval,
-		MesosSlaveQueryInterval:  *mesosSlaveQueryInterval,
+		DcosServiceAccountFile:    *dcosServiceAccountFile,
+		ExporterAddress:           *exporterAddress,
+		ExporterEndpoint:          *exporterEndpoint,
+		ExporterMode:              *exporterMode,
+		ExporterScrapeTimeout:     *exporterScrapeTimeout,
+		ExporterShutdownTimeout:   *exporterShutdownTimeout,
+		Filters:                   newItemFilters(filterRules),
+		LogLevel:                  logLevel,
+		MesosApiVersion:           *mesosApiVersion,
+		MesosCredentialFile:       *mesosCredentialFile,
+		MesosFrameworkExpiry:      *mesosFrameworkExpiry,
+		MesosIdleConnTimeout:      *mesosIdleConnTimeout,
+		MesosMaxIdleConns:         *mesosMaxIdleConns,
+		MesosMaxIdleConnsPerHost:  *mesosMaxIdleConnsPerHost,
+		MesosMaxResponseSize:      *mesosMaxResponseSize,
+		MesosMasterEndpoints:      *mesosMasterEndpoints,
+		MesosMasters:              masterUrls,
+		MesosMasterHealthInterval: *mesosMasterHealthInterval,
+		MesosMasterScheme:         scheme(*mesosMasterHttps),
+		MesosZkPath:               zkPath,
+		MesosZkServers:            zkServers,
+		MesosMasterQueryInterval:  *mesosMasterQueryInterval,
+		MesosMasterRequestTimeout: *mesosMasterRequestTimeout,
+		MesosMasterSubscribe:      *mesosMasterSubscribe,
+		MesosMasterTasksPageSize:  *mesosMasterTasksPageSize,
+		MesosSlaveAttributes:      slaveAttributes,
+		MesosSlaveAttributeLabels: slaveAttributeLabels,
+		MesosSlaveConcurrency:     *mesosSlaveConcurrency,
+		MesosSlavePidLabel:        *mesosSlavePidLabel,
+		MesosSlavePollTimeout:     *mesosSlavePollTimeout,
+		MesosSlaveQueryInterval:   *mesosSlaveQueryInterval,
+		MesosSlaveRequestTimeout:  *mesosSlaveRequestTimeout,
+		MesosSlaveScheme:          scheme(*mesosSlaveHttps),
+		MesosSlaveUrl:             *mesosSlaveUrl,
+		MesosSlaveUrlTemplate:     slaveUrlTemplate,
+		MesosSlaveFailureLimit:    failureLimit,
+		MesosSlaveBackoff:         *mesosSlaveBackoff,
+		MesosSlaveBackoffMax:      *mesosSlaveBackoffMax,
+		MesosTaskLabels:           taskLabels,
+		MesosTaskLabelNames:       labelNames,
+		MesosTaskLimit:            *mesosTaskLimit,
+		MesosTaskLimitOverflow:    *mesosTaskLimitOverflow,
+		MesosFrameworkTaskLimit:   *mesosTaskLimitPerFramework,
+		SdEndpoint:                *sdEndpoint,
+		SdFile:                    *sdFile,
+		TlsCaFile:                 *tlsCaFile,
+		TlsCertFile:               *tlsCertFile,
+		TlsInsecureSkipVerify:     *tlsInsecureSkipVerify,
+		TlsKeyFile:                *tlsKeyFile,
+		settings:                  settings,
+	}, nil
+}
+
+// Parses the template of -mesos.slave-url. Returns nil for the strategies that don't
+// need a template.
+func parseSlaveUrl(value string) (*template.Template, error) {
+	if value == slaveUrlDirect || value == slaveUrlMaster {
+		return nil, nil
+	}
+
+	if strings.Contains(value, "{{") == false {
+		return nil, fmt.Errorf("Must be '%s', '%s' or a template", slaveUrlDirect, slaveUrlMaster)
+	}
+
+	return template.New("slave-url").Option("missingkey=error").Parse(value)
+}
+
+func scheme(https bool) string {
+	if https {
+		return "https"
 	}
+
+	return "http"
+}
+
+// Splits a comma-separated list and drops empty items.
+func splitList(list string) []string {
+	items := []string{}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Splits a URL like 'zk://host1:2181,host2:2181/mesos' into the addresses of the
+// ZooKeeper servers and the path under which Mesos masters register.
+func parseZkUrl(rawUrl string) ([]string, string, error) {
+	rest := strings.TrimPrefix(rawUrl, "zk://")
+
+	slash := strings.Index(rest, "/")
+	if slash == -1 || slash == len(rest)-1 {
+		return nil, "", errors.New("Path missing")
+	}
+
+	hosts := rest[:slash]
+	path := strings.TrimSuffix(rest[slash:], "/")
+
+	if strings.Contains(hosts, "@") {
+		return nil, "", errors.New("Credentials are not supported")
+	}
+
+	servers := []string{}
+
+	for _, host := range strings.Split(hosts, ",") {
+		if host == "" {
+			continue
+		}
+
+		if strings.Contains(host, ":") == false {
+			host = host + ":2181"
+		}
+
+		servers = append(servers, host)
+	}
+
+	if len(servers) == 0 {
+		return nil, "", errors.New("No ZooKeeper servers given")
+	}
+
+	return servers, path, nil
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setCommandLine(t *testing.T, flags map[string]string) {
+	commandLine = flags
+	t.Cleanup(func() {
+		commandLine = make(map[string]string)
+	})
+}
+
+func TestEnvName(t *testing.T) {
+	require.Equal(t, "MESOS_SLAVE_POLLINTERVAL", envName("mesos.slave-pollinterval"))
+	require.Equal(t, "EXPORTER_ADDRESS", envName("exporter.address"))
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesos-task-exporter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeTempFile(t, dir, "config.yml", `
+exporter:
+  address: ":9105"
+mesos:
+  masters:
+  - http://master1:5050
+  - http://master2:5050
+  master-pollinterval: 30s
+  slave-pollinterval: 30s
+  task-labels: [team, service]
+`)
+
+	// The environment overrides the file, the command line overrides both
+	t.Setenv("MESOS_MASTER_POLLINTERVAL", "5s")
+	t.Setenv("MESOS_SLAVE_POLLINTERVAL", "10s")
+	setCommandLine(t, map[string]string{"config.file": path, "mesos.slave-pollinterval": "20s"})
+
+	conf, err := loadConfig()
+	require.NoError(t, err)
+
+	require.Equal(t, ":9105", conf.ExporterAddress)
+	require.Len(t, conf.MesosMasters, 2)
+	require.Equal(t, "master2:5050", conf.MesosMasters[1].Host)
+	require.Equal(t, 5*time.Second, conf.MesosMasterQueryInterval)
+	require.Equal(t, 20*time.Second, conf.MesosSlaveQueryInterval)
+	require.Equal(t, []string{"team", "service"}, conf.MesosTaskLabels)
+
+	// Defaults apply to everything else
+	require.Equal(t, "/metrics", conf.ExporterEndpoint)
+	require.Equal(t, apiVersionAuto, conf.MesosApiVersion)
+	require.Equal(t, 30*time.Second, conf.MesosMasterHealthInterval)
+}
+
+func TestLoadInvalidConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesos-task-exporter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, data := range map[string]string{
+		"unknown":     "mesos:\n  slaves: http://slave1:5051\n",
+		"duration":    "mesos:\n  slave-pollinterval: 15\n",
+		"filter":      "filter:\n  role-include: \"prod-(\"\n",
+		"concurrency": "mesos:\n  slave-concurrency: 0\n",
+		"endpoints":   "mesos:\n  master-endpoints: tasks\n",
+		"limit":       "mesos:\n  task-limit: -1\n",
+		"mode":        "exporter:\n  mode: push\n",
+		"overflow":    "mesos:\n  task-limit-overflow: keep\n",
+		"yaml":        "mesos: [",
+	} {
+		setCommandLine(t, map[string]string{"config.file": writeTempFile(t, dir, name, data)})
+
+		_, err := loadConfig()
+		require.Error(t, err, name)
+	}
+
+	setCommandLine(t, map[string]string{"config.file": dir + "/missing"})
+
+	_, err = loadConfig()
+	require.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesos-task-exporter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeTempFile(t, dir, "config.yml", "mesos:\n  masters: http://master1:5050\n")
+	setCommandLine(t, map[string]string{"config.file": path})
+
+	conf, err := loadConfig()
+	require.NoError(t, err)
+
+	e := &Exporter{config: conf, reloadMutex: &sync.Mutex{}}
+
+	reload := func() int {
+		w := httptest.NewRecorder()
+		e.ServeReload(w, httptest.NewRequest("POST", "/-/reload", nil))
+
+		return w.Code
+	}
+
+	// Intervals and masters are applied, the address requires a restart
+	writeTempFile(t, dir, "config.yml", `
+exporter:
+  address: ":9105"
+mesos:
+  masters: http://master1:5050,http://master2:5050
+  slave-pollinterval: 1m
+`)
+
+	require.Equal(t, http.StatusOK, reload())
+	require.Len(t, conf.masters(), 2)
+	require.Equal(t, time.Minute, conf.slaveQueryInterval())
+	require.Equal(t, ":55555", conf.ExporterAddress)
+
+	// An invalid config is rejected and the current one is kept
+	writeTempFile(t, dir, "config.yml", "mesos:\n  slave-pollinterval: often\n")
+
+	require.Equal(t, http.StatusBadRequest, reload())
+	require.Len(t, conf.masters(), 2)
+	require.Equal(t, time.Minute, conf.slaveQueryInterval())
+
+	// Masters in ZooKeeper can't replace a static list without a restart
+	writeTempFile(t, dir, "config.yml", "mesos:\n  masters: zk://zk1:2181/mesos\n")
+
+	require.Equal(t, http.StatusOK, reload())
+	require.Len(t, conf.masters(), 2)
+
+	w := httptest.NewRecorder()
+	e.ServeReload(w, httptest.NewRequest("GET", "/-/reload", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
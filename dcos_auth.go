@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dcosDefaultLoginEndpoint = "https://leader.mesos/acs/api/v1/auth/login"
+	// Lifetime assumed for authentication tokens that don't carry an expiry
+	dcosDefaultTokenLifetime = 5 * 24 * time.Hour
+	// Time a login may take before it is given up
+	dcosLoginTimeout = 30 * time.Second
+	// Lifetime of the login token that is exchanged for an authentication token
+	dcosLoginTokenLifetime = 5 * time.Minute
+)
+
+// A service account as created by 'dcos security org service-accounts keypair'
+// and stored as a secret.
+type dcosServiceAccount struct {
+	LoginEndpoint string `json:"login_endpoint"`
+	PrivateKey    string `json:"private_key"`
+	Scheme        string
+	Uid           string
+}
+
+func readDcosServiceAccount(path string) (dcosServiceAccount, error) {
+	var account dcosServiceAccount
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return account, err
+	}
+
+	err = json.Unmarshal(data, &account)
+	if err != nil {
+		return account, err
+	}
+
+	if account.Uid == "" || account.PrivateKey == "" {
+		return account, fmt.Errorf("No uid and private key found in '%s'", path)
+	}
+
+	if account.Scheme != "" && account.Scheme != "RS256" {
+		return account, fmt.Errorf("Unsupported scheme '%s' in '%s' - only RS256 is supported", account.Scheme, path)
+	}
+
+	if account.LoginEndpoint == "" {
+		account.LoginEndpoint = dcosDefaultLoginEndpoint
+	}
+
+	return account, nil
+}
+
+// Logs in to the DC/OS IAM with a service account and adds the authentication token
+// to every request. The token is refreshed after three quarters of its lifetime and
+// whenever a request is rejected with 401. Requests that need a token while a login
+// is in progress wait for it, but only as long as their own context allows.
+type dcosAuthTransport struct {
+	account dcosServiceAccount
+	key     *rsa.PrivateKey
+	// Login in progress, nil if there is none
+	login        *dcosLogin
+	loginTimeout time.Duration
+	// Guards login, refreshAt and token - never held during a request
+	mutex     *sync.Mutex
+	next      http.RoundTripper
+	now       func() time.Time
+	refreshAt time.Time
+	token     string
+}
+
+// A login that all requests in need of a token share. done is closed once token
+// or err are set.
+type dcosLogin struct {
+	done  chan struct{}
+	err   error
+	token string
+}
+
+func (t *dcosAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.currentToken(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(t.authorize(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// The request can only be repeated if its body can be read again
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+
+	log.Warnf("Token of service account '%s' has been rejected - logging in again", t.account.Uid)
+
+	token, err = t.renewToken(req.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+
+	retry := t.authorize(req, token)
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t.next.RoundTrip(retry)
+}
+
+// A RoundTripper must not modify the request it has been given
+func (t *dcosAuthTransport) authorize(req *http.Request, token string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "token="+token)
+
+	return req
+}
+
+func (t *dcosAuthTransport) currentToken(ctx context.Context) (string, error) {
+	t.mutex.Lock()
+
+	if t.token != "" && t.now().Before(t.refreshAt) {
+		token := t.token
+		t.mutex.Unlock()
+
+		return token, nil
+	}
+
+	login := t.startLogin(ctx)
+	t.mutex.Unlock()
+
+	return t.await(ctx, login)
+}
+
+// Logs in again unless another request did so since the rejected token was used.
+func (t *dcosAuthTransport) renewToken(ctx context.Context, rejected string) (string, error) {
+	t.mutex.Lock()
+
+	if t.token != rejected && t.token != "" {
+		token := t.token
+		t.mutex.Unlock()
+
+		return token, nil
+	}
+
+	t.token = ""
+
+	login := t.startLogin(ctx)
+	t.mutex.Unlock()
+
+	return t.await(ctx, login)
+}
+
+// Joins the login in progress or starts one. The login keeps the values of the
+// context of the request that started it, but not its cancellation - other
+// requests may still wait for it. It is bounded by the login timeout instead.
+// Must be called with the mutex held.
+func (t *dcosAuthTransport) startLogin(ctx context.Context) *dcosLogin {
+	if t.login != nil {
+		return t.login
+	}
+
+	login := &dcosLogin{done: make(chan struct{})}
+	t.login = login
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), t.loginTimeout)
+		defer cancel()
+
+		token, refreshAt, err := t.requestToken(ctx)
+
+		t.mutex.Lock()
+		if err == nil {
+			t.token = token
+			t.refreshAt = refreshAt
+		}
+		t.login = nil
+		t.mutex.Unlock()
+
+		login.token = token
+		login.err = err
+		close(login.done)
+	}()
+
+	return login
+}
+
+// Waits for the login to complete or gives up once ctx is done.
+func (t *dcosAuthTransport) await(ctx context.Context, login *dcosLogin) (string, error) {
+	select {
+	case <-login.done:
+		return login.token, login.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("Gave up waiting for the login of service account '%s': %w", t.account.Uid, ctx.Err())
+	}
+}
+
+// Exchanges a login token signed with the private key of the service account for
+// an authentication token. Returns the token and when it is to be refreshed.
+func (t *dcosAuthTransport) requestToken(ctx context.Context) (string, time.Time, error) {
+	now := t.now()
+
+	loginToken, err := signRS256(t.key, map[string]interface{}{
+		"exp": now.Add(dcosLoginTokenLifetime).Unix(),
+		"uid": t.account.Uid,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"token": loginToken,
+		"uid":   t.account.Uid,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	req, err := http.NewRequest("POST", t.account.LoginEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Unable to log in service account '%s': %w", t.account.Uid, err)
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("Unable to log in service account '%s': status code %d: %s", t.account.Uid, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	var res struct {
+		Token string
+	}
+
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if res.Token == "" {
+		return "", time.Time{}, fmt.Errorf("Unable to log in service account '%s': no token received", t.account.Uid)
+	}
+
+	lifetime := dcosDefaultTokenLifetime
+	if expiry, ok := tokenExpiry(res.Token); ok {
+		lifetime = expiry.Sub(now)
+	}
+
+	log.Debugf("Logged in service account '%s' - token expires in %s", t.account.Uid, lifetime)
+
+	return res.Token, now.Add(lifetime * 3 / 4), nil
+}
+
+func newDcosAuthTransport(account dcosServiceAccount, next http.RoundTripper) (*dcosAuthTransport, error) {
+	key, err := parseRsaPrivateKey(account.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dcosAuthTransport{
+		account:      account,
+		key:          key,
+		loginTimeout: dcosLoginTimeout,
+		mutex:        &sync.Mutex{},
+		next:         next,
+		now:          time.Now,
+	}, nil
+}
+
+// Accepts keys in PKCS #1 and PKCS #8 format.
+func parseRsaPrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("No PEM encoded private key found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if ok == false {
+		return nil, errors.New("Private key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+// Creates a JSON Web Token with the given claims signed with RS256.
+func signRS256(key *rsa.PrivateKey, claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(unsigned))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Reads the expiry of a JSON Web Token without verifying it.
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Exp float64
+	}
+
+	err = json.Unmarshal(payload, &claims)
+	if err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(claims.Exp), 0), true
+}
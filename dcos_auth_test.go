@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A DC/OS IAM that logs in a single service account and a Mesos endpoint that
+// only accepts tokens issued by it.
+type fakeIam struct {
+	key    *rsa.PublicKey
+	logins int
+	mutex  *sync.Mutex
+	tokens map[string]struct{}
+	uid    string
+}
+
+func (f *fakeIam) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.URL.Path != "/acs/api/v1/auth/login" {
+		if _, ok := f.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "token=")]; ok == false {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte(`{"leader": "master@10.0.0.1:5050"}`))
+		return
+	}
+
+	var login struct {
+		Token string
+		Uid   string
+	}
+
+	data, _ := ioutil.ReadAll(r.Body)
+	json.Unmarshal(data, &login)
+
+	if login.Uid != f.uid || f.verify(login.Token) == false {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"title": "Invalid login"}`))
+		return
+	}
+
+	f.logins = f.logins + 1
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"exp":   time.Now().Add(1 * time.Hour).Unix(),
+		"login": f.logins,
+		"uid":   f.uid,
+	})
+
+	token := "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+
+	f.tokens[token] = struct{}{}
+
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+func (f *fakeIam) verify(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	return rsa.VerifyPKCS1v15(f.key, crypto.SHA256, digest[:], signature) == nil
+}
+
+func (f *fakeIam) revokeTokens() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.tokens = make(map[string]struct{})
+}
+
+func (f *fakeIam) loginCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.logins
+}
+
+func writeServiceAccount(t *testing.T, dir string, key *rsa.PrivateKey, loginEndpoint string) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	data, _ := json.Marshal(dcosServiceAccount{
+		LoginEndpoint: loginEndpoint,
+		PrivateKey:    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		Scheme:        "RS256",
+		Uid:           "exporter",
+	})
+
+	return writeTempFile(t, dir, "service-account.json", string(data))
+}
+
+func TestTokenExpiry(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	token, err := signRS256(key, map[string]interface{}{"exp": 1500000000, "uid": "exporter"})
+	require.NoError(t, err)
+
+	expiry, ok := tokenExpiry(token)
+	require.True(t, ok)
+	require.Equal(t, int64(1500000000), expiry.Unix())
+
+	_, ok = tokenExpiry("opaque")
+	require.False(t, ok)
+}
+
+func TestDcosAuthTransport(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	iam := &fakeIam{
+		key:    &key.PublicKey,
+		mutex:  &sync.Mutex{},
+		tokens: make(map[string]struct{}),
+		uid:    "exporter",
+	}
+
+	ts := httptest.NewServer(iam)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "mesos-task-exporter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := newHttpClient(&Config{
+		DcosServiceAccountFile: writeServiceAccount(t, dir, key, ts.URL+"/acs/api/v1/auth/login"),
+	})
+	require.NoError(t, err)
+
+	api := newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"})
+
+	var master Master
+
+	// The first request logs in, following requests reuse the token
+	require.NoError(t, api.masterState(c, &master, ts.URL))
+	require.NoError(t, api.masterState(c, &master, ts.URL))
+	require.Equal(t, 1, iam.loginCount())
+
+	// A rejected token is replaced right away
+	iam.revokeTokens()
+
+	require.NoError(t, api.masterState(c, &master, ts.URL))
+	require.Equal(t, 2, iam.loginCount())
+
+	// The token is refreshed before it expires
+	transport := c.Transport.(*dcosAuthTransport)
+	transport.now = func() time.Time {
+		return time.Now().Add(50 * time.Minute)
+	}
+
+	require.NoError(t, api.masterState(c, &master, ts.URL))
+	require.Equal(t, 3, iam.loginCount())
+
+	// Requests fail if the service account is not accepted
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	c, err = newHttpClient(&Config{
+		DcosServiceAccountFile: writeServiceAccount(t, dir, other, ts.URL+"/acs/api/v1/auth/login"),
+	})
+	require.NoError(t, err)
+
+	err = api.masterState(c, &master, ts.URL)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Invalid login")
+}
+
+func TestDcosAuthLoginTimeout(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	block := make(chan struct{})
+	mutex := &sync.Mutex{}
+	logins := 0
+
+	// An IAM that never responds
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		logins = logins + 1
+		mutex.Unlock()
+
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	dir, err := ioutil.TempDir("", "mesos-task-exporter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := newHttpClient(&Config{
+		DcosServiceAccountFile: writeServiceAccount(t, dir, key, ts.URL+"/acs/api/v1/auth/login"),
+	})
+	require.NoError(t, err)
+
+	transport := c.Transport.(*dcosAuthTransport)
+	transport.loginTimeout = 200 * time.Millisecond
+
+	api := newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"})
+
+	// Requests give up waiting for the login within their own deadline and share
+	// a single login
+	errs := make([]error, 2)
+	durations := make([]time.Duration, 2)
+
+	wg := &sync.WaitGroup{}
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var master Master
+
+			start := time.Now()
+			errs[i] = api.masterState(newDeadlineClient(context.Background(), c, 20*time.Millisecond), &master, ts.URL)
+			durations[i] = time.Since(start)
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i, err := range errs {
+		require.Equal(t, errorClassTimeout, errorClass(err))
+		require.True(t, durations[i] < 150*time.Millisecond, "took %s", durations[i])
+	}
+
+	mutex.Lock()
+	require.Equal(t, 1, logins)
+	mutex.Unlock()
+
+	// The login itself is given up after the login timeout
+	require.True(t, waitFor(func() bool {
+		transport.mutex.Lock()
+		defer transport.mutex.Unlock()
+
+		return transport.login == nil
+	}))
+}
@@ -1,36 +1,210 @@
 package main
 
 import (
+	"context"
+	log "github.com/Sirupsen/logrus"
 	"github.com/prometheus/client_golang/prometheus"
+	"net"
 	"net/http"
+	"sync"
 )
 
 type Exporter struct {
+	api               *mesosApi
 	config            *Config
 	frameworkRegistry *frameworkRegistry
 	httpClient        *http.Client
+	masterDetector    *zkMasterDetector
+	reloadMutex       *sync.Mutex
 }
 
-func (e *Exporter) Run() {
-	http.Handle(e.config.ExporterEndpoint, prometheus.Handler())
+// Loads the configuration again and applies it to the running pollers. The current
+// configuration is kept if the new one is invalid.
+func (e *Exporter) Reload() error {
+	e.reloadMutex.Lock()
+	defer e.reloadMutex.Unlock()
 
-	go http.ListenAndServe(e.config.ExporterAddress, nil)
+	conf, err := loadConfig()
+	if err != nil {
+		log.Errorf("Unable to reload configuration - keeping the current one: %s", err)
+		return err
+	}
 
-	mp := masterPoller{
-		config:            e.config,
-		frameworkRegistry: e.frameworkRegistry,
-		httpClient:        e.httpClient,
+	for _, name := range e.config.apply(conf) {
+		log.Warnf("Changing '%s' requires a restart - keeping the current value", name)
 	}
 
-	go mp.run()
+	log.Info("Reloaded configuration")
+
+	return nil
+}
+
+// Reloads the configuration on a POST or PUT like Prometheus does.
+func (e *Exporter) ServeReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := e.Reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// Serves metrics and queries Mesos until ctx is cancelled. Scrapes in progress are
+// completed before the pollers are stopped, both within ExporterShutdownTimeout.
+func (e *Exporter) Run(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle(e.config.ExporterEndpoint, prometheus.Handler())
+	mux.HandleFunc("/-/reload", e.ServeReload)
+
+	var discovery *serviceDiscovery
+	if e.config.SdEndpoint != "" || e.config.SdFile != "" {
+		discovery = newServiceDiscovery(e.config)
+	}
+
+	if e.config.SdEndpoint != "" {
+		mux.Handle(e.config.SdEndpoint, discovery)
+	}
+
+	listener, err := net.Listen("tcp", e.config.ExporterAddress)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: mux}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve(listener)
+	}()
+
+	// Pollers are stopped separately from ctx, after the server has been shut down
+	pollCtx, stopPollers := context.WithCancel(context.Background())
+	defer stopPollers()
+
+	var pollers sync.WaitGroup
+
+	start := func(run func(ctx context.Context)) {
+		pollers.Add(1)
+
+		go func() {
+			defer pollers.Done()
+			run(pollCtx)
+		}()
+	}
+
+	// Unregistered once the exporter stopped
+	var collectors []prometheus.Collector
+
+	register := func(c prometheus.Collector) {
+		prometheus.MustRegister(c)
+		collectors = append(collectors, c)
+	}
+
+	defer func() {
+		for _, c := range collectors {
+			prometheus.Unregister(c)
+		}
+	}()
+
+	register(e.api.metrics)
+
+	if e.config.Filters != nil {
+		register(e.config.Filters)
+	}
+
+	limiter := newTaskLimiter(e.config)
+	register(limiter)
+
+	if e.config.masterHealthInterval() > 0 {
+		checker := newMasterHealthChecker(e.httpClient, e.config, e.masterDetector)
+		register(checker)
+		start(checker.run)
+	}
+
+	var subscriber *masterSubscriber
+	if e.config.MesosMasterSubscribe {
+		subscriber = newMasterSubscriber(e.httpClient, e.config, e.masterDetector, e.frameworkRegistry)
+		register(subscriber.transitions)
+		start(subscriber.run)
+	}
+
+	if e.config.ExporterMode == modeScrape {
+		register(newScrapeCollector(e.httpClient, e.api, e.config, e.masterDetector, discovery, limiter))
+	} else {
+		mp := &masterPoller{
+			api:               e.api,
+			config:            e.config,
+			detector:          e.masterDetector,
+			discovery:         discovery,
+			frameworkRegistry: e.frameworkRegistry,
+			httpClient:        e.httpClient,
+			limiter:           limiter,
+			subscriber:        subscriber,
+		}
+
+		start(mp.run)
+	}
+
+	select {
+	case err = <-serverErr:
+		log.Errorf("Unable to serve metrics: %s", err)
+	case <-ctx.Done():
+		log.Info("Shutting down...")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), e.config.ExporterShutdownTimeout)
+	defer cancel()
+
+	shutdownErr := server.Shutdown(shutdownCtx)
+	if shutdownErr != nil {
+		log.Warnf("Scrapes in progress did not complete in time: %s", shutdownErr)
+	}
+
+	stopPollers()
+
+	stopped := make(chan struct{})
+	go func() {
+		pollers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		log.Warn("Pollers did not stop in time")
+	}
+
+	if e.masterDetector != nil {
+		e.masterDetector.Stop()
+	}
+
+	return err
 }
 
 func NewExporter(config *Config) *Exporter {
-	c := &http.Client{}
+	var detector *zkMasterDetector
+
+	c, err := newHttpClient(config)
+	if err != nil {
+		log.Fatalf("Unable to set up connections to Mesos: %s", err)
+	}
+
+	if len(config.MesosZkServers) > 0 {
+		detector, err = newZkMasterDetector(config.MesosZkServers, config.MesosZkPath, config.MesosMasterScheme)
+		if err != nil {
+			log.Fatalf("Unable to connect to ZooKeeper: %s", err)
+		}
+	}
 
 	return &Exporter{
+		api:               newMesosApi(config),
 		config:            config,
-		frameworkRegistry: NewFrameworkRegistry(),
+		frameworkRegistry: NewFrameworkRegistry(config.MesosFrameworkExpiry),
 		httpClient:        c,
+		masterDetector:    detector,
+		reloadMutex:       &sync.Mutex{},
 	}
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Blocks scrapes until it is released.
+type blockingCollector struct {
+	desc      *prometheus.Desc
+	release   chan struct{}
+	requested chan struct{}
+}
+
+func (c *blockingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *blockingCollector) Collect(ch chan<- prometheus.Metric) {
+	c.requested <- struct{}{}
+	<-c.release
+
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1)
+}
+
+func TestExporterShutdown(t *testing.T) {
+	var masterUrl *url.URL
+
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"leader": "master@` + masterUrl.Host + `"}`))
+	}))
+	defer master.Close()
+
+	masterUrl, _ = url.Parse(master.URL)
+
+	blocking := &blockingCollector{
+		desc:      prometheus.NewDesc("mesos_exporter_test_blocking", "Blocks scrapes", nil, nil),
+		release:   make(chan struct{}),
+		requested: make(chan struct{}, 1),
+	}
+
+	prometheus.MustRegister(blocking)
+	defer prometheus.Unregister(blocking)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	l.Close()
+
+	conf := &Config{
+		ExporterAddress:          address,
+		ExporterEndpoint:         "/metrics",
+		ExporterMode:             modePoll,
+		ExporterShutdownTimeout:  5 * time.Second,
+		MesosApiVersion:          apiVersionV0,
+		MesosMasterQueryInterval: 1 * time.Hour,
+		MesosMasters:             []*url.URL{masterUrl},
+		MesosSlaveScheme:         "http",
+	}
+
+	e := &Exporter{
+		api:               newMesosApi(conf),
+		config:            conf,
+		frameworkRegistry: NewFrameworkRegistry(0),
+		httpClient:        &http.Client{},
+		reloadMutex:       &sync.Mutex{},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- e.Run(ctx)
+	}()
+
+	require.True(t, waitFor(func() bool {
+		resp, err := http.Get("http://" + address + "/-/reload")
+		if err != nil {
+			return false
+		}
+
+		resp.Body.Close()
+
+		return resp.StatusCode == http.StatusMethodNotAllowed
+	}))
+
+	type result struct {
+		body string
+		err  error
+	}
+
+	scraped := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + address + "/metrics")
+		if err != nil {
+			scraped <- result{err: err}
+			return
+		}
+
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		scraped <- result{string(body), err}
+	}()
+
+	// Stop the exporter while a scrape is in progress
+	<-blocking.requested
+	cancel()
+
+	select {
+	case <-stopped:
+		t.Fatal("Exporter stopped before the scrape in progress completed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(blocking.release)
+
+	res := <-scraped
+	require.NoError(t, res.err)
+	require.Contains(t, res.body, "mesos_exporter_test_blocking 1")
+	// The first poll of the master may still be in progress
+	require.Contains(t, res.body, "mesos_master_has_leader ")
+
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Exporter did not stop")
+	}
+
+	// New connections are refused
+	_, err = http.Get("http://" + address + "/metrics")
+	require.Error(t, err)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"regexp"
+)
+
+const (
+	filteredFramework = "framework"
+	filteredSlave     = "slave"
+	filteredTask      = "task"
+)
+
+// Include and exclude rules for one property, e.g. the name of a framework. Either
+// regular expression may be nil.
+type filterRule struct {
+	exclude *regexp.Regexp
+	include *regexp.Regexp
+}
+
+// An item with several values of a property, e.g. the attributes of a slave, is
+// kept if any value is included and no value is excluded.
+func (r filterRule) keep(values ...string) bool {
+	if r.include != nil {
+		included := false
+
+		for _, value := range values {
+			if r.include.MatchString(value) {
+				included = true
+				break
+			}
+		}
+
+		if included == false {
+			return false
+		}
+	}
+
+	if r.exclude != nil {
+		for _, value := range values {
+			if r.exclude.MatchString(value) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Regular expressions are anchored at both ends like in the relabeling rules of
+// Prometheus.
+func newFilterRule(include string, exclude string) (filterRule, error) {
+	var rule filterRule
+	var err error
+
+	if include != "" {
+		rule.include, err = regexp.Compile("^(?:" + include + ")$")
+		if err != nil {
+			return rule, fmt.Errorf("Invalid include rule '%s': %s", include, err)
+		}
+	}
+
+	if exclude != "" {
+		rule.exclude, err = regexp.Compile("^(?:" + exclude + ")$")
+		if err != nil {
+			return rule, fmt.Errorf("Invalid exclude rule '%s': %s", exclude, err)
+		}
+	}
+
+	return rule, nil
+}
+
+// Decides which frameworks, tasks and slaves are exported and counts the ones that
+// are not. A nil filter keeps everything.
+type itemFilters struct {
+	executorId     filterRule
+	filtered       *prometheus.CounterVec
+	frameworkId    filterRule
+	frameworkName  filterRule
+	role           filterRule
+	slaveAttribute filterRule
+	taskName       filterRule
+}
+
+func (f *itemFilters) Describe(ch chan<- *prometheus.Desc) {
+	f.filtered.Describe(ch)
+}
+
+func (f *itemFilters) Collect(ch chan<- prometheus.Metric) {
+	f.filtered.Collect(ch)
+}
+
+func (f *itemFilters) keepFramework(framework Framework) bool {
+	if f.matchFramework(framework) {
+		return true
+	}
+
+	f.filtered.WithLabelValues(filteredFramework).Inc()
+
+	return false
+}
+
+// Tasks of frameworks that are filtered are filtered as well.
+func (f *itemFilters) keepTask(executorId string, framework Framework, task Task) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.matchFramework(framework) && f.executorId.keep(executorId) && f.taskName.keep(task.Name) {
+		return true
+	}
+
+	f.filtered.WithLabelValues(filteredTask).Inc()
+
+	return false
+}
+
+// Attributes are matched as 'name:value'.
+func (f *itemFilters) keepSlave(slave Slave) bool {
+	if f == nil {
+		return true
+	}
+
+	attributes := []string{}
+	for name, value := range slave.Attributes {
+		attributes = append(attributes, fmt.Sprintf("%s:%v", name, value))
+	}
+
+	if f.slaveAttribute.keep(attributes...) {
+		return true
+	}
+
+	f.filtered.WithLabelValues(filteredSlave).Inc()
+
+	return false
+}
+
+func (f *itemFilters) matchFramework(framework Framework) bool {
+	if f == nil {
+		return true
+	}
+
+	return f.frameworkId.keep(framework.Id) && f.frameworkName.keep(framework.Name) && f.role.keep(framework.roles()...)
+}
+
+// Rules by the name of the property, e.g. 'framework-name'.
+func newItemFilters(rules map[string]filterRule) *itemFilters {
+	return &itemFilters{
+		executorId: rules["executor-id"],
+		filtered: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Help:      "Frameworks, tasks and slaves that were not exported because of a filter",
+				Name:      "filtered_items",
+				Namespace: namespace,
+				Subsystem: "exporter",
+			},
+			[]string{"kind"}),
+		frameworkId:    rules["framework-id"],
+		frameworkName:  rules["framework-name"],
+		role:           rules["role"],
+		slaveAttribute: rules["slave-attribute"],
+		taskName:       rules["task-name"],
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func filteredItems(t *testing.T, f *itemFilters, kind string) float64 {
+	out := &dto.Metric{}
+	require.NoError(t, f.filtered.WithLabelValues(kind).Write(out))
+
+	return out.GetCounter().GetValue()
+}
+
+func TestFilterRule(t *testing.T) {
+	rule, err := newFilterRule("", "")
+	require.NoError(t, err)
+	require.True(t, rule.keep("anything"))
+
+	rule, err = newFilterRule("prod-.*", "prod-batch")
+	require.NoError(t, err)
+	require.True(t, rule.keep("prod-web"))
+	require.False(t, rule.keep("prod-batch"))
+	require.False(t, rule.keep("dev-web"))
+
+	// Rules match the whole value
+	require.False(t, rule.keep("my-prod-web"))
+
+	// Any value can be included, but none excluded
+	require.True(t, rule.keep("dev-web", "prod-web"))
+	require.False(t, rule.keep("prod-web", "prod-batch"))
+	require.False(t, rule.keep())
+
+	_, err = newFilterRule("prod-(", "")
+	require.Error(t, err)
+
+	_, err = newFilterRule("", "prod-(")
+	require.Error(t, err)
+}
+
+func TestItemFilters(t *testing.T) {
+	frameworkName, _ := newFilterRule("marathon|chronos", "")
+	role, _ := newFilterRule("", "test")
+	slaveAttribute, _ := newFilterRule("", "rack:r[23]")
+	taskName, _ := newFilterRule("", "sidecar-.*")
+
+	f := newItemFilters(map[string]filterRule{
+		"framework-name":  frameworkName,
+		"role":            role,
+		"slave-attribute": slaveAttribute,
+		"task-name":       taskName,
+	})
+
+	marathon := Framework{Name: "marathon", Role: "prod"}
+	chronos := Framework{Name: "chronos", Roles: []string{"prod", "test"}}
+	spark := Framework{Name: "spark", Role: "prod"}
+
+	require.True(t, f.keepFramework(marathon))
+	require.False(t, f.keepFramework(chronos))
+	require.False(t, f.keepFramework(spark))
+	require.Equal(t, 2.0, filteredItems(t, f, filteredFramework))
+
+	// Tasks of filtered frameworks are filtered as well
+	require.True(t, f.keepTask("web.1", marathon, Task{Name: "web"}))
+	require.False(t, f.keepTask("sidecar.1", marathon, Task{Name: "sidecar-logs"}))
+	require.False(t, f.keepTask("job.1", spark, Task{Name: "job"}))
+	require.Equal(t, 2.0, filteredItems(t, f, filteredTask))
+
+	require.True(t, f.keepSlave(Slave{Attributes: map[string]interface{}{"rack": "r1"}}))
+	require.True(t, f.keepSlave(Slave{}))
+	require.False(t, f.keepSlave(Slave{Attributes: map[string]interface{}{"rack": "r2", "zone": "a"}}))
+	require.Equal(t, 1.0, filteredItems(t, f, filteredSlave))
+
+	// Everything is kept without filters
+	var none *itemFilters
+
+	require.True(t, none.keepFramework(spark))
+	require.True(t, none.keepTask("sidecar.1", marathon, Task{Name: "sidecar-logs"}))
+	require.True(t, none.keepSlave(Slave{Attributes: map[string]interface{}{"rack": "r2"}}))
+}
@@ -1,32 +1,122 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"sync"
+	"time"
 )
 
+type registeredFramework struct {
+	framework Framework
+	// Last time the Mesos master reported the framework
+	seen time.Time
+}
+
+// Identifies a task or an executor by its ID within a framework.
+type taskKey struct {
+	frameworkId string
+	id          string
+}
+
+// Frameworks known to the exporter and an index of their tasks by the IDs of the
+// tasks and their executors. The registry is replaced with every poll of the Mesos
+// master. Frameworks that the master does not report anymore are kept for the
+// expiry time, so that tasks which are still running on a slave can be resolved
+// while the master fails over.
 type frameworkRegistry struct {
-	mutex    *sync.Mutex
-	registry map[string]Framework
+	executors  map[taskKey][]Task
+	expiry     time.Duration
+	frameworks map[string]registeredFramework
+	mutex      *sync.RWMutex
+	tasks      map[taskKey]Task
 }
 
+// Returns a copy of the registered frameworks by ID.
 func (fr *frameworkRegistry) All() map[string]Framework {
+	fr.mutex.RLock()
+	defer fr.mutex.RUnlock()
+
+	frameworks := make(map[string]Framework, len(fr.frameworks))
+	for id, registered := range fr.frameworks {
+		frameworks[id] = registered.framework
+	}
+
+	return frameworks
+}
+
+func (fr *frameworkRegistry) Delete(id string) {
 	fr.mutex.Lock()
 	defer fr.mutex.Unlock()
 
-	return fr.registry
+	fr.unindex(id)
+	delete(fr.frameworks, id)
 }
 
 func (fr *frameworkRegistry) Get(id string) (Framework, error) {
+	fr.mutex.RLock()
+	defer fr.mutex.RUnlock()
+
+	registered, ok := fr.frameworks[id]
+	if ok == false {
+		return Framework{}, fmt.Errorf("Unknown framework '%s'", id)
+	}
+
+	return registered.framework, nil
+}
+
+// Finds the tasks that an executor of the given framework runs. Returns false if
+// the framework is unknown.
+func (fr *frameworkRegistry) Lookup(frameworkId string, executorId string) (Framework, []Task, bool) {
+	fr.mutex.RLock()
+	defer fr.mutex.RUnlock()
+
+	registered, ok := fr.frameworks[frameworkId]
+	if ok == false {
+		return Framework{}, nil, false
+	}
+
+	return registered.framework, fr.executors[taskKey{frameworkId, executorId}], true
+}
+
+func (fr *frameworkRegistry) LookupTask(frameworkId string, taskId string) (Framework, Task, bool) {
+	fr.mutex.RLock()
+	defer fr.mutex.RUnlock()
+
+	registered, ok := fr.frameworks[frameworkId]
+	if ok == false {
+		return Framework{}, Task{}, false
+	}
+
+	task, ok := fr.tasks[taskKey{frameworkId, taskId}]
+
+	return registered.framework, task, ok
+}
+
+// Replaces all frameworks with the ones the Mesos master currently reports.
+// Frameworks that are missing are dropped once they expired.
+func (fr *frameworkRegistry) Replace(frameworks []Framework) {
+	now := time.Now()
+
 	fr.mutex.Lock()
 	defer fr.mutex.Unlock()
 
-	fw, ok := fr.registry[id]
-	if ok {
-		return fw, nil
-	} else {
-		return Framework{}, errors.New(fmt.Sprintf("Unknown framwork '%s'", id))
+	registered := make(map[string]registeredFramework, len(frameworks))
+	for _, framework := range frameworks {
+		registered[framework.Id] = registeredFramework{framework, now}
+	}
+
+	for id, known := range fr.frameworks {
+		if _, ok := registered[id]; ok == false && now.Sub(known.seen) < fr.expiry {
+			registered[id] = known
+		}
+	}
+
+	fr.executors = make(map[taskKey][]Task)
+	fr.frameworks = registered
+	fr.tasks = make(map[taskKey]Task)
+
+	for _, known := range registered {
+		fr.index(known.framework)
 	}
 }
 
@@ -34,12 +124,43 @@ func (fr *frameworkRegistry) Set(framework Framework) {
 	fr.mutex.Lock()
 	defer fr.mutex.Unlock()
 
-	fr.registry[framework.Id] = framework
+	fr.unindex(framework.Id)
+	fr.frameworks[framework.Id] = registeredFramework{framework, time.Now()}
+	fr.index(framework)
+}
+
+// Adds the tasks of a framework to the index. Must be called with the mutex held.
+func (fr *frameworkRegistry) index(framework Framework) {
+	for _, task := range framework.Tasks {
+		executor := taskKey{framework.Id, task.executorId()}
+
+		fr.executors[executor] = append(fr.executors[executor], task)
+		fr.tasks[taskKey{framework.Id, task.Id}] = task
+	}
+}
+
+// Removes the tasks of a framework from the index. Must be called with the mutex
+// held.
+func (fr *frameworkRegistry) unindex(id string) {
+	known, ok := fr.frameworks[id]
+	if ok == false {
+		return
+	}
+
+	for _, task := range known.framework.Tasks {
+		delete(fr.executors, taskKey{id, task.executorId()})
+		delete(fr.tasks, taskKey{id, task.Id})
+	}
 }
 
-func NewFrameworkRegistry() *frameworkRegistry {
+// Frameworks that the Mesos master does not report anymore are dropped after
+// expiry.
+func NewFrameworkRegistry(expiry time.Duration) *frameworkRegistry {
 	return &frameworkRegistry{
-		mutex:    &sync.Mutex{},
-		registry: make(map[string]Framework),
+		executors:  make(map[taskKey][]Task),
+		expiry:     expiry,
+		frameworks: make(map[string]registeredFramework),
+		mutex:      &sync.RWMutex{},
+		tasks:      make(map[taskKey]Task),
 	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestFrameworkRegistry(t *testing.T) {
+	registry := NewFrameworkRegistry(time.Minute)
+
+	registry.Replace([]Framework{
+		{Id: "fw1", Name: "marathon", Tasks: []Task{{Id: "web.1", Name: "web"}, {Id: "db.1", Name: "db"}}},
+		{Id: "fw2", Name: "chronos", Tasks: []Task{{Id: "job.1", Name: "job"}}},
+		{Id: "fw3", Name: "aurora", Tasks: []Task{{ExecutorId: "thermos-1", Id: "1", Name: "api"}}},
+		{Id: "fw4", Name: "pods", Tasks: []Task{{ExecutorId: "default", Id: "a", Name: "app"}, {ExecutorId: "default", Id: "b", Name: "sidecar"}}},
+	})
+
+	// Tasks are found by their executor
+	_, tasks, ok := registry.Lookup("fw1", "web.1")
+	require.True(t, ok)
+	require.Equal(t, []Task{{Id: "web.1", Name: "web"}}, tasks)
+
+	_, tasks, ok = registry.Lookup("fw3", "thermos-1")
+	require.True(t, ok)
+	require.Equal(t, "api", tasks[0].Name)
+
+	_, tasks, ok = registry.Lookup("fw4", "default")
+	require.True(t, ok)
+	require.Len(t, tasks, 2)
+
+	_, tasks, ok = registry.Lookup("fw3", "1")
+	require.True(t, ok)
+	require.Len(t, tasks, 0)
+
+	_, _, ok = registry.Lookup("fw5", "1")
+	require.False(t, ok)
+
+	framework, task, ok := registry.LookupTask("fw1", "db.1")
+	require.True(t, ok)
+	require.Equal(t, "marathon", framework.Name)
+	require.Equal(t, "db", task.Name)
+
+	_, _, ok = registry.LookupTask("fw2", "db.1")
+	require.False(t, ok)
+
+	// The copy is not affected by later changes
+	all := registry.All()
+	delete(all, "fw1")
+
+	_, err := registry.Get("fw1")
+	require.NoError(t, err)
+
+	registry.Delete("fw3")
+	registry.Delete("fw4")
+
+	// A framework that is gone is kept until it expired
+	registry.Replace([]Framework{{Id: "fw1", Name: "marathon", Tasks: []Task{{Id: "web.2", Name: "web"}}}})
+
+	_, _, ok = registry.LookupTask("fw1", "web.1")
+	require.False(t, ok)
+
+	_, _, ok = registry.LookupTask("fw1", "web.2")
+	require.True(t, ok)
+
+	_, _, ok = registry.LookupTask("fw2", "job.1")
+	require.True(t, ok)
+
+	expired := registry.frameworks["fw2"]
+	expired.seen = time.Now().Add(-time.Minute)
+	registry.frameworks["fw2"] = expired
+
+	registry.Replace([]Framework{{Id: "fw1", Name: "marathon"}})
+
+	_, _, ok = registry.LookupTask("fw2", "job.1")
+	require.False(t, ok)
+	require.Len(t, registry.All(), 1)
+	require.Len(t, registry.executors, 0)
+	require.Len(t, registry.tasks, 0)
+
+	// Single frameworks are updated by events of the master
+	registry.Set(Framework{Id: "fw2", Name: "chronos", Tasks: []Task{{Id: "job.2", Name: "job"}}})
+
+	_, _, ok = registry.LookupTask("fw2", "job.2")
+	require.True(t, ok)
+
+	registry.Delete("fw2")
+
+	_, _, ok = registry.LookupTask("fw2", "job.2")
+	require.False(t, ok)
+	require.Len(t, registry.tasks, 0)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A principal and secret as used by Mesos for HTTP authentication.
+type credential struct {
+	Principal string
+	Secret    string
+}
+
+// Adds HTTP Basic credentials to every request.
+type basicAuthTransport struct {
+	credential credential
+	next       http.RoundTripper
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it has been given
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.credential.Principal, t.credential.Secret)
+
+	return t.next.RoundTrip(req)
+}
+
+// Bounds every request by a timeout of its own and by ctx, e.g. the deadline of a
+// whole poll of a slave. The context of the request itself is replaced.
+type deadlineTransport struct {
+	ctx     context.Context
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := t.ctx, context.CancelFunc(func() {})
+	if t.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+	}
+
+	resp, err := t.next.RoundTrip(req.Clone(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The timeout also covers reading the body
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+
+	return b.ReadCloser.Close()
+}
+
+// Returns a client that shares the connections of c, but whose requests time out
+// after timeout each and are cancelled with ctx. A timeout of 0 does not apply.
+func newDeadlineClient(ctx context.Context, c *http.Client, timeout time.Duration) *http.Client {
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &http.Client{Transport: &deadlineTransport{ctx: ctx, next: next, timeout: timeout}}
+}
+
+// Reads a credential file in one of the formats that Mesos accepts: a JSON object
+// with principal and secret, a JSON list of credentials of which the first is used,
+// or a principal and a secret separated by whitespace.
+func readCredential(path string) (credential, error) {
+	var c credential
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+
+	trimmed := strings.TrimSpace(string(data))
+
+	if strings.HasPrefix(trimmed, "{") {
+		var list struct {
+			Credentials []credential
+			credential
+		}
+
+		err = json.Unmarshal(data, &list)
+		if err != nil {
+			return c, err
+		}
+
+		c = list.credential
+		if len(list.Credentials) > 0 {
+			c = list.Credentials[0]
+		}
+	} else {
+		fields := strings.Fields(trimmed)
+		if len(fields) == 2 {
+			c = credential{Principal: fields[0], Secret: fields[1]}
+		}
+	}
+
+	if c.Principal == "" || c.Secret == "" {
+		return c, fmt.Errorf("No principal and secret found in '%s'", path)
+	}
+
+	return c, nil
+}
+
+func newTlsConfig(conf *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: conf.TlsInsecureSkipVerify,
+	}
+
+	if conf.TlsCaFile != "" {
+		data, err := ioutil.ReadFile(conf.TlsCaFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if pool.AppendCertsFromPEM(data) == false {
+			return nil, fmt.Errorf("No certificates found in '%s'", conf.TlsCaFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if (conf.TlsCertFile == "") != (conf.TlsKeyFile == "") {
+		return nil, errors.New("A client certificate requires both a certificate and a key file")
+	}
+
+	if conf.TlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TlsCertFile, conf.TlsKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Builds the client that is shared by all requests to Mesos masters and slaves.
+// Idle connections are kept alive between polls.
+func newHttpClient(conf *Config) (*http.Client, error) {
+	tlsConfig, err := newTlsConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.IdleConnTimeout = conf.MesosIdleConnTimeout
+	transport.MaxIdleConns = conf.MesosMaxIdleConns
+	transport.MaxIdleConnsPerHost = conf.MesosMaxIdleConnsPerHost
+	transport.TLSClientConfig = tlsConfig
+
+	var rt http.RoundTripper = transport
+
+	if conf.MesosCredentialFile != "" {
+		c, err := readCredential(conf.MesosCredentialFile)
+		if err != nil {
+			return nil, err
+		}
+
+		rt = &basicAuthTransport{credential: c, next: rt}
+	}
+
+	if conf.DcosServiceAccountFile != "" {
+		account, err := readDcosServiceAccount(conf.DcosServiceAccountFile)
+		if err != nil {
+			return nil, err
+		}
+
+		rt, err = newDcosAuthTransport(account, rt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &http.Client{Transport: rt}, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, dir string, name string, data string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+
+	return path
+}
+
+func TestReadCredential(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesos-task-exporter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	expected := credential{Principal: "exporter", Secret: "s3cret"}
+
+	for name, data := range map[string]string{
+		"object.json": `{"principal": "exporter", "secret": "s3cret"}`,
+		"list.json":   `{"credentials": [{"principal": "exporter", "secret": "s3cret"}, {"principal": "other", "secret": "other"}]}`,
+		"text":        "exporter s3cret\n",
+	} {
+		c, err := readCredential(writeTempFile(t, dir, name, data))
+		require.NoError(t, err, name)
+		require.Equal(t, expected, c, name)
+	}
+
+	_, err = readCredential(writeTempFile(t, dir, "invalid", "exporter"))
+	require.Error(t, err)
+
+	_, err = readCredential(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestHttpClient(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, secret, ok := r.BasicAuth()
+		if ok == false || principal != "exporter" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/master/state.json":
+			w.Write([]byte(`{"leader": "master@10.0.0.1:5050"}`))
+		case "/monitor/statistics.json":
+			w.Write([]byte(`[{"executor_id": "task1", "framework_id": "fw1", "statistics": {"cpus_limit": 1}}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "mesos-task-exporter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+
+	conf := &Config{
+		MesosCredentialFile: writeTempFile(t, dir, "credential", "exporter s3cret"),
+		TlsCaFile:           writeTempFile(t, dir, "ca.pem", string(ca)),
+	}
+
+	c, err := newHttpClient(conf)
+	require.NoError(t, err)
+
+	api := newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "https"})
+
+	var master Master
+	require.NoError(t, api.masterState(c, &master, ts.URL))
+	require.Equal(t, "master@10.0.0.1:5050", master.Leader)
+
+	slaveUrl, _ := url.Parse(ts.URL)
+
+	var stats []MonitoredTask
+	require.NoError(t, api.slaveStats(c, &stats, Slave{Pid: "slave(1)@" + slaveUrl.Host}))
+	require.Len(t, stats, 1)
+
+	// Requests without credentials are rejected
+	conf.MesosCredentialFile = ""
+
+	c, err = newHttpClient(conf)
+	require.NoError(t, err)
+	require.Error(t, api.masterState(c, &master, ts.URL))
+
+	// The certificate of the server is not trusted without the CA file
+	conf.TlsCaFile = ""
+
+	c, err = newHttpClient(conf)
+	require.NoError(t, err)
+	require.Error(t, api.masterState(c, &master, ts.URL))
+
+	conf.TlsInsecureSkipVerify = true
+
+	c, err = newHttpClient(conf)
+	require.NoError(t, err)
+
+	_, err = c.Get(ts.URL)
+	require.NoError(t, err)
+
+	// A certificate without a key is rejected
+	conf.TlsCertFile = filepath.Join(dir, "cert.pem")
+
+	_, err = newHttpClient(conf)
+	require.Error(t, err)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var invalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// Labels that are set by the exporter itself and can't be used for attributes.
+var reservedLabels = map[string]struct{}{
+	"agent_id":       struct{}{},
+	"executor_id":    struct{}{},
+	"framework":      struct{}{},
+	"hostname":       struct{}{},
+	"pid":            struct{}{},
+	"port_name":      struct{}{},
+	"resource":       struct{}{},
+	"slave_hostname": struct{}{},
+	"slave_pid":      struct{}{},
+	"task":           struct{}{},
+}
+
+// Turns an arbitrary string into a valid Prometheus label name.
+func sanitizeLabelName(name string) string {
+	sanitized := invalidLabelChars.ReplaceAllString(name, "_")
+
+	if sanitized == "" || (sanitized[0] >= '0' && sanitized[0] <= '9') {
+		sanitized = "_" + sanitized
+	}
+
+	return sanitized
+}
+
+// Maps keys, e.g. names of slave attributes, to the names of the labels they are
+// exported as. Fails if a key maps to a reserved label name, a name in taken or the
+// same name as another key.
+func mapLabelNames(kind string, keys []string, taken map[string]struct{}) ([]string, error) {
+	names := []string{}
+	seen := make(map[string]string)
+
+	for _, key := range keys {
+		name := sanitizeLabelName(key)
+
+		if strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("%s '%s' maps to label '%s' - label names starting with '__' are reserved", kind, key, name)
+		}
+
+		if _, ok := reservedLabels[name]; ok {
+			return nil, fmt.Errorf("%s '%s' conflicts with label '%s' of the exporter", kind, key, name)
+		}
+
+		if _, ok := taken[name]; ok {
+			return nil, fmt.Errorf("%s '%s' conflicts with label '%s'", kind, key, name)
+		}
+
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("%ss '%s' and '%s' map to the same label '%s'", kind, other, key, name)
+		}
+
+		seen[name] = key
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// Maps the names of slave attributes to the names of the labels they are exported as.
+func attributeLabelNames(attributes []string) ([]string, error) {
+	return mapLabelNames("Attribute", attributes, nil)
+}
+
+// Maps the keys of Mesos task labels to the names of the labels they are exported
+// as. Names of labels of slave attributes are taken already.
+func mesosLabelNames(keys []string, attributeLabels []string) ([]string, error) {
+	taken := make(map[string]struct{})
+	for _, name := range attributeLabels {
+		taken[name] = struct{}{}
+	}
+
+	return mapLabelNames("Task label", keys, taken)
+}
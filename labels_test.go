@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestAttributeLabelNames(t *testing.T) {
+	names, err := attributeLabelNames([]string{"rack", "instance-type", "1zone"})
+
+	require.NoError(t, err)
+	require.Equal(t, []string{"rack", "instance_type", "_1zone"}, names)
+
+	_, err = attributeLabelNames([]string{"task"})
+	require.Error(t, err)
+
+	_, err = attributeLabelNames([]string{"instance-type", "instance.type"})
+	require.Error(t, err)
+
+	_, err = attributeLabelNames([]string{"__name__"})
+	require.Error(t, err)
+}
+
+func TestSlaveAttributeValues(t *testing.T) {
+	slave := Slave{
+		Attributes: map[string]interface{}{
+			"cores": 8.0,
+			"rack":  "r1",
+		},
+	}
+
+	require.Equal(t, []string{"r1", "8", ""}, slave.attributeValues([]string{"rack", "cores", "zone"}))
+}
+
+func TestMesosLabelNames(t *testing.T) {
+	names, err := mesosLabelNames([]string{"team", "HAPROXY_GROUP", "owner.email"}, []string{"rack"})
+
+	require.NoError(t, err)
+	require.Equal(t, []string{"team", "HAPROXY_GROUP", "owner_email"}, names)
+
+	_, err = mesosLabelNames([]string{"rack"}, []string{"rack"})
+	require.Error(t, err)
+
+	_, err = mesosLabelNames([]string{"executor_id"}, nil)
+	require.Error(t, err)
+}
+
+func TestTaskLabelValues(t *testing.T) {
+	task := Task{
+		Labels: []Label{
+			{Key: "team", Value: "infra"},
+			{Key: "owner", Value: "alice"},
+		},
+	}
+
+	require.Equal(t, []string{"alice", "", "infra"}, task.labelValues([]string{"owner", "env", "team"}))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"sync"
+)
+
+// Address of the leader in a PID like 'master@10.0.0.1:5050'. Masters report an
+// empty leader while an election is in progress.
+func leaderAddress(leader string) (string, bool) {
+	parts := strings.Split(leader, "@")
+	if len(parts) != 2 || parts[1] == "" {
+		return "", false
+	}
+
+	return parts[1], true
+}
+
+// Keeps track of the leading Mesos master across queries.
+type leaderMetrics struct {
+	changes     prometheus.Counter
+	electedTime prometheus.Gauge
+	hasLeader   prometheus.Gauge
+	info        *prometheus.GaugeVec
+	leader      string
+	mutex       *sync.Mutex
+	// Only masters queried through the legacy endpoints report when they were elected
+	reportsElectedTime bool
+}
+
+func (m *leaderMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.changes.Desc()
+	ch <- m.electedTime.Desc()
+	ch <- m.hasLeader.Desc()
+	m.info.Describe(ch)
+}
+
+func (m *leaderMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ch <- m.changes
+	ch <- m.hasLeader
+	m.info.Collect(ch)
+
+	if m.reportsElectedTime {
+		ch <- m.electedTime
+	}
+}
+
+// Records the outcome of querying the current leader. A failed query means that no
+// leader could be found.
+func (m *leaderMetrics) update(master Master, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err != nil || master.Leader == "" {
+		m.hasLeader.Set(0)
+		m.info.Reset()
+		m.reportsElectedTime = false
+		return
+	}
+
+	m.hasLeader.Set(1)
+
+	if master.Leader != m.leader {
+		// The first leader that is found is not a change
+		if m.leader != "" {
+			m.changes.Inc()
+		}
+
+		m.info.Reset()
+		m.leader = master.Leader
+	}
+
+	version := master.Version
+	if version == "" {
+		version = master.LeaderInfo.Version
+	}
+
+	m.info.WithLabelValues(master.Leader, master.LeaderInfo.Hostname, version).Set(1)
+
+	m.reportsElectedTime = master.ElectedTime != nil
+	if master.ElectedTime != nil {
+		m.electedTime.Set(*master.ElectedTime)
+	}
+}
+
+func newLeaderMetrics() *leaderMetrics {
+	return &leaderMetrics{
+		changes: prometheus.NewCounter(prometheus.CounterOpts{
+			Help:      "Number of times another Mesos master became the leader",
+			Name:      "leader_changes_total",
+			Namespace: namespace,
+			Subsystem: "master",
+		}),
+		electedTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Help:      "Time when the current leader was elected in seconds since the epoch",
+			Name:      "elected_time_seconds",
+			Namespace: namespace,
+			Subsystem: "master",
+		}),
+		hasLeader: prometheus.NewGauge(prometheus.GaugeOpts{
+			Help:      "Whether a leading Mesos master has been found",
+			Name:      "has_leader",
+			Namespace: namespace,
+			Subsystem: "master",
+		}),
+		info: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Help:      "Information about the leading Mesos master",
+				Name:      "leader_info",
+				Namespace: namespace,
+				Subsystem: "master",
+			},
+			[]string{"pid", "hostname", "version"}),
+		mutex: &sync.Mutex{},
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func leaderChanges(t *testing.T, m *leaderMetrics) float64 {
+	changes := collectMetrics(m)[m.changes.Desc().String()]
+	require.Len(t, changes, 1)
+
+	return changes[0].GetCounter().GetValue()
+}
+
+func leaderInfo(m *leaderMetrics) []*dto.Metric {
+	ch := make(chan *prometheus.Desc, 1)
+	m.info.Describe(ch)
+
+	return collectMetrics(m)[(<-ch).String()]
+}
+
+func TestLeaderAddress(t *testing.T) {
+	address, ok := leaderAddress("master@10.0.0.1:5050")
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.1:5050", address)
+
+	for _, leader := range []string{"", "master", "master@", "master@10.0.0.1@5050"} {
+		_, ok := leaderAddress(leader)
+		require.False(t, ok, leader)
+	}
+}
+
+func TestNoLeader(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"leader": ""}`))
+	}))
+	defer ts.Close()
+
+	masterUrl, _ := url.Parse(ts.URL)
+
+	m := masterPoller{
+		api: newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}),
+		config: &Config{
+			MesosMasters: []*url.URL{masterUrl},
+		},
+		httpClient:    &http.Client{},
+		leaderMetrics: newLeaderMetrics(),
+	}
+
+	// Polling during an election must not panic
+	m.poll(context.Background(), make(map[string]Slave))
+
+	require.Nil(t, m.currentMesosMaster)
+	require.Equal(t, 0.0, gaugeValue(t, m.leaderMetrics.hasLeader))
+
+	require.Len(t, leaderInfo(m.leaderMetrics), 0)
+	require.Len(t, collectMetrics(m.leaderMetrics)[m.leaderMetrics.electedTime.Desc().String()], 0)
+}
+
+func TestFlappingLeader(t *testing.T) {
+	var masterUrls [2]*url.URL
+	var leader int32
+
+	newMaster := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			current := atomic.LoadInt32(&leader)
+			electedTime := 1500000000.0 + float64(current)
+
+			data, _ := json.Marshal(Master{
+				ElectedTime: &electedTime,
+				Leader:      "master@" + masterUrls[current].Host,
+				LeaderInfo:  MasterInfo{Hostname: fmt.Sprintf("master%d", current+1)},
+				Version:     "1.4.0",
+			})
+
+			w.Write(data)
+		}))
+	}
+
+	first := newMaster()
+	defer first.Close()
+	second := newMaster()
+	defer second.Close()
+
+	masterUrls[0], _ = url.Parse(first.URL)
+	masterUrls[1], _ = url.Parse(second.URL)
+
+	m := masterPoller{
+		api: newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}),
+		config: &Config{
+			MesosMasters: masterUrls[:],
+		},
+		httpClient: &http.Client{},
+	}
+
+	metrics := newLeaderMetrics()
+
+	for i := 0; i < 4; i++ {
+		atomic.StoreInt32(&leader, int32(i%2))
+
+		master, err := m.retrieveCurrentMasterState(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, masterUrls[i%2], m.currentMesosMaster)
+
+		metrics.update(master, err)
+	}
+
+	// The first leader found is not counted as a change
+	require.Equal(t, 3.0, leaderChanges(t, metrics))
+	require.Equal(t, 1.0, gaugeValue(t, metrics.hasLeader))
+	require.Equal(t, 1500000001.0, gaugeValue(t, metrics.electedTime))
+
+	// Only the current leader is reported
+	info := leaderInfo(metrics)
+	require.Len(t, info, 1)
+
+	labels := make(map[string]string)
+	for _, pair := range info[0].GetLabel() {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+
+	require.Equal(t, map[string]string{
+		"hostname": "master2",
+		"pid":      "master@" + masterUrls[1].Host,
+		"version":  "1.4.0",
+	}, labels)
+
+	// An election in progress does not count as a change either
+	metrics.update(Master{}, nil)
+	require.Equal(t, 0.0, gaugeValue(t, metrics.hasLeader))
+	require.Len(t, leaderInfo(metrics), 0)
+
+	atomic.StoreInt32(&leader, 1)
+
+	master, err := m.retrieveCurrentMasterState(context.Background())
+	metrics.update(master, err)
+	require.Equal(t, 3.0, leaderChanges(t, metrics))
+}
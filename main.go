@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	log "github.com/Sirupsen/logrus"
 	"os"
 	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -13,13 +15,36 @@ func main() {
 
 	e := NewExporter(config)
 
-	go e.Run()
+	hup := make(chan os.Signal, 1)
+
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			log.Info("Received SIGHUP - reloading configuration")
+			e.Reload()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
 
 	sc := make(chan os.Signal, 1)
 
-	signal.Notify(sc, os.Interrupt, os.Kill)
+	signal.Notify(sc, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		s := <-sc
+		log.Infof("Received signal: %s", s)
+
+		// A second signal terminates the exporter right away
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		cancel()
+	}()
+
+	err := e.Run(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	s := <-sc
-	log.Infof("Received signal: %s", s)
-	log.Info("Shutting down...")
+	log.Info("Stopped")
 }
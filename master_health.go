@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// What a single check of a Mesos master found out. Fields that could not be
+// determined are nil.
+type masterHealth struct {
+	elected   *float64
+	healthy   bool
+	quorum    *float64
+	recovered *float64
+	version   string
+}
+
+// Checks every Mesos master, not only the leader, so that a standby master that is
+// down is noticed before a failover depends on it. The masters are either
+// configured or registered in ZooKeeper.
+type masterHealthChecker struct {
+	config     *Config
+	detector   *zkMasterDetector
+	elected    *prometheus.GaugeVec
+	httpClient *http.Client
+	masters    map[string]struct{}
+	quorum     *prometheus.GaugeVec
+	recovered  *prometheus.GaugeVec
+	up         *prometheus.GaugeVec
+	version    *prometheus.GaugeVec
+	versions   map[string]string
+}
+
+func (h *masterHealthChecker) Describe(ch chan<- *prometheus.Desc) {
+	h.elected.Describe(ch)
+	h.quorum.Describe(ch)
+	h.recovered.Describe(ch)
+	h.up.Describe(ch)
+	h.version.Describe(ch)
+}
+
+func (h *masterHealthChecker) Collect(ch chan<- prometheus.Metric) {
+	h.elected.Collect(ch)
+	h.quorum.Collect(ch)
+	h.recovered.Collect(ch)
+	h.up.Collect(ch)
+	h.version.Collect(ch)
+}
+
+// Checks the masters until ctx is cancelled.
+func (h *masterHealthChecker) run(ctx context.Context) {
+	h.checkAll(ctx)
+
+	interval := h.config.masterHealthInterval()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		h.checkAll(ctx)
+
+		// Pick up an interval changed by a reload
+		if current := h.config.masterHealthInterval(); current != interval {
+			interval = current
+			ticker.Reset(interval)
+		}
+	}
+}
+
+// Checks all masters in parallel. A check that takes longer than the interval is
+// cancelled so that rounds don't overlap.
+func (h *masterHealthChecker) checkAll(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, h.config.masterHealthInterval())
+	defer cancel()
+
+	masters := h.config.masters()
+	if h.detector != nil {
+		masters = h.detector.Masters()
+	}
+
+	results := make([]masterHealth, len(masters))
+
+	var wg sync.WaitGroup
+
+	for i, masterUrl := range masters {
+		wg.Add(1)
+
+		go func(i int, masterUrl *url.URL) {
+			defer wg.Done()
+			results[i] = h.check(ctx, masterUrl)
+		}(i, masterUrl)
+	}
+
+	wg.Wait()
+
+	checked := make(map[string]struct{})
+
+	for i, masterUrl := range masters {
+		h.record(masterUrl.String(), results[i])
+		checked[masterUrl.String()] = struct{}{}
+	}
+
+	// Masters that have been removed from the configuration or left ZooKeeper
+	for master := range h.masters {
+		if _, ok := checked[master]; ok == false {
+			h.remove(master)
+		}
+	}
+
+	h.masters = checked
+}
+
+// Queries /health first - the other endpoints are only queried if the master is
+// healthy. They are cheap compared to /master/state, which carries all tasks.
+func (h *masterHealthChecker) check(ctx context.Context, masterUrl *url.URL) masterHealth {
+	var health masterHealth
+
+	base := masterUrl.String()
+
+	err := getJson(ctx, h.httpClient, base+"/health", nil)
+	if err != nil {
+		log.Warnf("Mesos master '%s' is not healthy: %s", base, err)
+		return health
+	}
+
+	health.healthy = true
+
+	var version struct {
+		Version string
+	}
+
+	err = getJson(ctx, h.httpClient, base+"/version", &version)
+	if err != nil {
+		log.Debugf("Unable to retrieve version of Mesos master '%s': %s", base, err)
+	}
+
+	health.version = version.Version
+
+	var snapshot map[string]float64
+
+	err = getJson(ctx, h.httpClient, base+"/metrics/snapshot", &snapshot)
+	if err != nil {
+		log.Debugf("Unable to retrieve metrics of Mesos master '%s': %s", base, err)
+	}
+
+	if value, ok := snapshot["master/elected"]; ok {
+		health.elected = &value
+	}
+
+	// Only reported by masters that use the replicated log
+	if value, ok := snapshot["registrar/log/recovered"]; ok {
+		health.recovered = &value
+	}
+
+	var flags struct {
+		Flags map[string]string
+	}
+
+	err = getJson(ctx, h.httpClient, base+"/master/flags", &flags)
+	if err != nil {
+		log.Debugf("Unable to retrieve flags of Mesos master '%s': %s", base, err)
+	}
+
+	if value, err := strconv.ParseFloat(flags.Flags["quorum"], 64); err == nil {
+		health.quorum = &value
+	}
+
+	return health
+}
+
+// Metrics that could not be determined are removed rather than left at a stale
+// value.
+func (h *masterHealthChecker) record(master string, health masterHealth) {
+	if health.healthy {
+		h.up.WithLabelValues(master).Set(1)
+	} else {
+		h.up.WithLabelValues(master).Set(0)
+	}
+
+	setOrDelete(h.elected, health.elected, master)
+	setOrDelete(h.quorum, health.quorum, master)
+	setOrDelete(h.recovered, health.recovered, master)
+
+	if previous, ok := h.versions[master]; ok && previous != health.version {
+		h.version.DeleteLabelValues(master, previous)
+		delete(h.versions, master)
+	}
+
+	if health.version != "" {
+		h.version.WithLabelValues(master, health.version).Set(1)
+		h.versions[master] = health.version
+	}
+}
+
+func (h *masterHealthChecker) remove(master string) {
+	h.elected.DeleteLabelValues(master)
+	h.quorum.DeleteLabelValues(master)
+	h.recovered.DeleteLabelValues(master)
+	h.up.DeleteLabelValues(master)
+
+	if version, ok := h.versions[master]; ok {
+		h.version.DeleteLabelValues(master, version)
+		delete(h.versions, master)
+	}
+}
+
+func setOrDelete(g *prometheus.GaugeVec, value *float64, labels ...string) {
+	if value == nil {
+		g.DeleteLabelValues(labels...)
+		return
+	}
+
+	g.WithLabelValues(labels...).Set(*value)
+}
+
+// Decodes the response into res unless res is nil.
+func getJson(ctx context.Context, c *http.Client, url string, res interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{resp.StatusCode, fmt.Sprintf("Unexpected status code %d from '%s'", resp.StatusCode, url)}
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if res == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, res)
+}
+
+func newMasterHealthChecker(c *http.Client, conf *Config, detector *zkMasterDetector) *masterHealthChecker {
+	return &masterHealthChecker{
+		config:   conf,
+		detector: detector,
+		elected: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Help:      "Whether the Mesos master considers itself the elected leader",
+				Name:      "elected",
+				Namespace: namespace,
+				Subsystem: "master",
+			},
+			[]string{"master"}),
+		httpClient: c,
+		quorum: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Help:      "Number of masters the Mesos master needs to reach to persist changes",
+				Name:      "quorum",
+				Namespace: namespace,
+				Subsystem: "master",
+			},
+			[]string{"master"}),
+		recovered: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Help:      "Whether the replicated log of the Mesos master has recovered",
+				Name:      "registrar_log_recovered",
+				Namespace: namespace,
+				Subsystem: "master",
+			},
+			[]string{"master"}),
+		up: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Help:      "Whether the Mesos master reports itself as healthy",
+				Name:      "up",
+				Namespace: namespace,
+				Subsystem: "master",
+			},
+			[]string{"master"}),
+		version: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Help:      "Version of the Mesos master",
+				Name:      "version_info",
+				Namespace: namespace,
+				Subsystem: "master",
+			},
+			[]string{"master", "version"}),
+		versions: make(map[string]string),
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func fakeHealthyMaster(elected bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+		case "/version":
+			w.Write([]byte(`{"version": "1.4.0"}`))
+		case "/metrics/snapshot":
+			if elected {
+				w.Write([]byte(`{"master/elected": 1, "registrar/log/recovered": 1}`))
+			} else {
+				w.Write([]byte(`{"master/elected": 0, "registrar/log/recovered": 1}`))
+			}
+		case "/master/flags":
+			w.Write([]byte(`{"flags": {"quorum": "2"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestMasterHealthChecker(t *testing.T) {
+	leader := fakeHealthyMaster(true)
+	defer leader.Close()
+
+	standby := fakeHealthyMaster(false)
+	defer standby.Close()
+
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	var masterUrls []*url.URL
+	for _, rawUrl := range []string{leader.URL, standby.URL, unhealthy.URL, down.URL} {
+		masterUrl, _ := url.Parse(rawUrl)
+		masterUrls = append(masterUrls, masterUrl)
+	}
+
+	h := newMasterHealthChecker(&http.Client{}, &Config{
+		MesosMasterHealthInterval: 5 * time.Second,
+		MesosMasters:              masterUrls,
+	}, nil)
+
+	h.checkAll(context.Background())
+
+	require.Equal(t, 1.0, gaugeValue(t, h.up.WithLabelValues(leader.URL)))
+	require.Equal(t, 1.0, gaugeValue(t, h.up.WithLabelValues(standby.URL)))
+	require.Equal(t, 0.0, gaugeValue(t, h.up.WithLabelValues(unhealthy.URL)))
+	require.Equal(t, 0.0, gaugeValue(t, h.up.WithLabelValues(down.URL)))
+
+	require.Equal(t, 1.0, gaugeValue(t, h.elected.WithLabelValues(leader.URL)))
+	require.Equal(t, 0.0, gaugeValue(t, h.elected.WithLabelValues(standby.URL)))
+	require.Equal(t, 2.0, gaugeValue(t, h.quorum.WithLabelValues(standby.URL)))
+	require.Equal(t, 1.0, gaugeValue(t, h.recovered.WithLabelValues(standby.URL)))
+	require.Equal(t, 1.0, gaugeValue(t, h.version.WithLabelValues(leader.URL, "1.4.0")))
+
+	// Whether the 4 masters are up, elected, quorum, log recovery and version of the
+	// 2 healthy ones
+	require.Equal(t, 4+2*4, countMetrics(h))
+
+	// Metrics of a master that went down are removed, except whether it is up
+	standby.Close()
+	h.checkAll(context.Background())
+
+	require.Equal(t, 0.0, gaugeValue(t, h.up.WithLabelValues(standby.URL)))
+	require.Equal(t, 4+1*4, countMetrics(h))
+}
+
+func countMetrics(c prometheus.Collector) int {
+	count := 0
+	for _, m := range collectMetrics(c) {
+		count = count + len(m)
+	}
+
+	return count
+}
+
+func TestMasterHealthCheckerZk(t *testing.T) {
+	leader := fakeHealthyMaster(true)
+	defer leader.Close()
+
+	standby := fakeHealthyMaster(false)
+	defer standby.Close()
+
+	leaderUrl, _ := url.Parse(leader.URL)
+	standbyUrl, _ := url.Parse(standby.URL)
+
+	s := newFakeZkServer(t)
+	defer s.Close()
+
+	s.Set("/mesos/json.info_0000000001", masterInfo("master@"+leaderUrl.Host))
+	s.Set("/mesos/json.info_0000000002", masterInfo("master@"+standbyUrl.Host))
+
+	d, err := newZkMasterDetector([]string{s.Addr()}, "/mesos", "http")
+	require.NoError(t, err)
+	defer d.Stop()
+
+	<-d.changes
+
+	// Masters registered in ZooKeeper are checked instead of -mesos.masters
+	h := newMasterHealthChecker(&http.Client{}, &Config{MesosMasterHealthInterval: 5 * time.Second, MesosMasters: []*url.URL{leaderUrl}}, d)
+
+	h.checkAll(context.Background())
+
+	require.Equal(t, 1.0, gaugeValue(t, h.elected.WithLabelValues(leader.URL)))
+	require.Equal(t, 0.0, gaugeValue(t, h.elected.WithLabelValues(standby.URL)))
+	require.Equal(t, 2*5, countMetrics(h))
+
+	// A master that left ZooKeeper is not checked anymore
+	s.Set("/mesos/json.info_0000000002", nil)
+	require.True(t, waitFor(func() bool { return len(d.Masters()) == 1 }))
+
+	h.checkAll(context.Background())
+
+	require.Equal(t, 5, countMetrics(h))
+}
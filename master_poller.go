@@ -1,13 +1,14 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/prometheus/client_golang/prometheus"
-	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,57 +17,249 @@ type Framework struct {
 	Active        bool
 	Id            string
 	Name          string
+	Role          string
+	Roles         []string
 	Tasks         []Task
 	UsedResources Resources `json:"used_resources"`
 }
 
+// Frameworks that subscribed with several roles report them in Roles.
+func (f *Framework) roles() []string {
+	if len(f.Roles) > 0 {
+		return f.Roles
+	}
+
+	return []string{f.Role}
+}
+
+// Task counters are nil if the master did not report them.
 type Master struct {
-	FailedTasks   float64 `json:"failed_tasks"`
-	FinishedTasks float64 `json:"finished_tasks"`
+	ElectedTime   *float64 `json:"elected_time"`
+	FailedTasks   *float64 `json:"failed_tasks"`
+	FinishedTasks *float64 `json:"finished_tasks"`
 	Frameworks    []Framework
 	Leader        string
-	LostTasks     float64 `json:"lost_tasks"`
-	KilledTasks   float64 `json:"killed_tasks"`
-	StagedTasks   float64 `json:"staged_tasks"`
-	StartedTasks  float64 `json:"started_tasks"`
+	LeaderInfo    MasterInfo `json:"leader_info"`
+	LostTasks     *float64   `json:"lost_tasks"`
+	KilledTasks   *float64   `json:"killed_tasks"`
+	StagedTasks   *float64   `json:"staged_tasks"`
+	StartedTasks  *float64   `json:"started_tasks"`
 	Slaves        []Slave
+	Version       string
+}
+
+// Cluster-wide task counters by status.
+func (m *Master) taskCounters() map[string]*float64 {
+	return map[string]*float64{
+		"failed":   m.FailedTasks,
+		"finished": m.FinishedTasks,
+		"killed":   m.KilledTasks,
+		"lost":     m.LostTasks,
+		"staged":   m.StagedTasks,
+		"started":  m.StartedTasks,
+	}
 }
 
+// Disk and Mem are measured in megabytes.
 type Resources struct {
 	Cpus  float64
 	Disk  float64
+	Gpus  float64
 	Mem   float64
 	Ports string
 }
 
+const megabyte = 1024 * 1024
+
+type portRange struct {
+	begin int
+	end   int
+}
+
+// Parses port resources in the format used by Mesos, e.g. "[31000-31002, 31005-31005]".
+func parsePortRanges(ports string) ([]portRange, error) {
+	ranges := []portRange{}
+
+	trimmed := strings.Trim(ports, "[] ")
+	if trimmed == "" {
+		return ranges, nil
+	}
+
+	for _, part := range strings.Split(trimmed, ",") {
+		bounds := strings.Split(strings.TrimSpace(part), "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Invalid port range '%s'", part)
+		}
+
+		begin, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := strconv.Atoi(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+
+		if end < begin {
+			return nil, fmt.Errorf("Invalid port range '%s'", part)
+		}
+
+		ranges = append(ranges, portRange{begin: begin, end: end})
+	}
+
+	return ranges, nil
+}
+
+func countPorts(ranges []portRange) int {
+	count := 0
+	for _, r := range ranges {
+		count = count + r.end - r.begin + 1
+	}
+
+	return count
+}
+
 type Slave struct {
-	Pid       string
-	Resources Resources
+	Active     bool
+	Attributes map[string]interface{}
+	Hostname   string
+	Id         string
+	Pid        string
+	Resources  Resources
+}
+
+// Identifies the slave across restarts on another port. Masters that don't report
+// the ID of a slave leave it identified by its PID.
+func (s *Slave) key() string {
+	if s.Id != "" {
+		return s.Id
+	}
+
+	return s.Pid
+}
+
+// Values of the given attributes in the same order. Attributes that are not set
+// on the slave have an empty value.
+func (s *Slave) attributeValues(attributes []string) []string {
+	values := make([]string, len(attributes))
+
+	for i, attribute := range attributes {
+		value, ok := s.Attributes[attribute]
+		if ok {
+			values[i] = fmt.Sprint(value)
+		}
+	}
+
+	return values
 }
 
-func (s *Slave) address() string {
+// Address of the slave in its PID like 'slave(1)@10.0.0.1:5051'. Returns false if
+// the PID is empty or has no address.
+func (s *Slave) address() (string, bool) {
 	parts := strings.Split(s.Pid, "@")
-	return parts[1]
+	if len(parts) != 2 || parts[1] == "" {
+		return "", false
+	}
+
+	return parts[1], true
+}
+
+// A slave that re-registers with a new ID is reported under both IDs until the
+// master removes the old one. Only one slave is kept per PID, preferring the
+// active one, so that it isn't queried twice.
+func uniqueSlaves(slaves []Slave) []Slave {
+	unique := []Slave{}
+	byPid := make(map[string]int)
+
+	for _, slave := range slaves {
+		i, ok := byPid[slave.Pid]
+		if ok == false {
+			byPid[slave.Pid] = len(unique)
+			unique = append(unique, slave)
+			continue
+		}
+
+		log.Warnf("Slaves '%s' and '%s' share the PID '%s'", unique[i].Id, slave.Id, slave.Pid)
+
+		if slave.Active && unique[i].Active == false {
+			unique[i] = slave
+		}
+	}
+
+	return unique
+}
+
+type Label struct {
+	Key   string
+	Value string
 }
 
 type Task struct {
-	Id   string
-	Name string
+	Discovery  *Discovery
+	ExecutorId string `json:"executor_id"`
+	Id         string
+	Labels     []Label
+	Name       string
+	Resources  Resources
+	SlaveId    string `json:"slave_id"`
+	State      string
+}
+
+// Tasks of the command executor and the Docker executor have no executor ID of
+// their own - their executor is named after the task.
+func (t *Task) executorId() string {
+	if t.ExecutorId != "" {
+		return t.ExecutorId
+	}
+
+	return t.Id
+}
+
+// Values of the labels with the given keys in the same order. Labels that are not
+// set on the task have an empty value.
+func (t *Task) labelValues(keys []string) []string {
+	values := make([]string, len(keys))
+
+	for i, key := range keys {
+		for _, label := range t.Labels {
+			if label.Key == key {
+				values[i] = label.Value
+				break
+			}
+		}
+	}
+
+	return values
 }
 
 type masterPoller struct {
+	api                *mesosApi
 	config             *Config
 	currentMesosMaster *url.URL
+	detector           *zkMasterDetector
+	discovery          *serviceDiscovery
+	// Frameworks and slaves that have been filtered by ID, remembered while the master
+	// reports them so that they are only matched and counted once
+	filteredFrameworks map[string]struct{}
+	filteredSlaves     map[string]struct{}
 	frameworkResources *prometheus.GaugeVec
 	frameworkRegistry  *frameworkRegistry
 	httpClient         *http.Client
+	leaderMetrics      *leaderMetrics
+	limiter            *taskLimiter
+	scheduler          *slaveScheduler
 	slaveResources     *prometheus.GaugeVec
+	subscriber         *masterSubscriber
 	tasksCounterVec    *prometheus.CounterVec
 }
 
 // Periodically queries a Mesos master to check for new slaves.
-func (e *masterPoller) run() {
-	knownSlaves := make(map[string]struct{})
+// Polls the master until ctx is cancelled and then stops the pollers of all slaves.
+func (e *masterPoller) run(ctx context.Context) {
+	knownSlaves := make(map[string]Slave)
+
+	e.scheduler = newSlaveScheduler(ctx, e.httpClient, e.api, e.config, e.frameworkRegistry, e.limiter)
 
 	e.frameworkResources = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -77,6 +270,7 @@ func (e *masterPoller) run() {
 		},
 		[]string{"name", "resource", "type"})
 	prometheus.MustRegister(e.frameworkResources)
+	defer prometheus.Unregister(e.frameworkResources)
 
 	e.slaveResources = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -85,8 +279,9 @@ func (e *masterPoller) run() {
 			Namespace: "mesos",
 			Subsystem: "slave",
 		},
-		[]string{"pid", "resource"})
+		slaveResourcesLabelNames(e.config))
 	prometheus.MustRegister(e.slaveResources)
+	defer prometheus.Unregister(e.slaveResources)
 
 	e.tasksCounterVec = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -96,25 +291,74 @@ func (e *masterPoller) run() {
 		},
 		[]string{"status"})
 	prometheus.MustRegister(e.tasksCounterVec)
+	defer prometheus.Unregister(e.tasksCounterVec)
+
+	e.leaderMetrics = newLeaderMetrics()
+	prometheus.MustRegister(e.leaderMetrics)
+	defer prometheus.Unregister(e.leaderMetrics)
+
+	// Poll right away when ZooKeeper reports a new leader
+	var leaderChanges <-chan struct{}
+	if e.detector != nil {
+		leaderChanges = e.detector.changes
+	}
+
+	// The subscriber reports slaves that join or leave the cluster right away. The
+	// state of the master is only polled to catch up with what the events missed.
+	var slaveChanges <-chan struct{}
+	if e.subscriber != nil {
+		slaveChanges = e.subscriber.changes
+	}
+
+	e.poll(ctx, knownSlaves)
+
+	interval := e.config.masterQueryInterval()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
 
-	e.poll(knownSlaves)
+	for {
+		select {
+		case <-ctx.Done():
+			e.scheduler.Stop()
 
-	t := time.Tick(e.config.MesosMasterQueryInterval)
+			return
+		case <-t.C:
+			e.poll(ctx, knownSlaves)
+		case <-leaderChanges:
+			e.poll(ctx, knownSlaves)
+		case <-slaveChanges:
+			e.updateSlaves(knownSlaves, e.subscriber.Agents())
+		}
 
-	for _ = range t {
-		e.poll(knownSlaves)
+		// Pick up an interval changed by a reload
+		if current := e.config.masterQueryInterval(); current != interval {
+			interval = current
+			t.Reset(interval)
+		}
 	}
 }
 
-func (e *masterPoller) retrieveCurrentMasterState() (Master, error) {
-	if e.currentMesosMaster != nil {
+// Queries the leader with requests that time out after -mesos.master-request-timeout
+// each and are cancelled with ctx.
+func (e *masterPoller) retrieveCurrentMasterState(ctx context.Context) (Master, error) {
+	client := newDeadlineClient(ctx, e.httpClient, e.config.masterRequestTimeout())
+
+	if e.detector != nil {
+		return e.retrieveDetectedMasterState(client)
+	}
+
+	masters := e.config.masters()
+
+	if e.currentMesosMaster != nil && containsUrl(masters, e.currentMesosMaster) {
 		var master Master
 
-		err := retrieveMasterState(e.httpClient, &master, e.currentMesosMaster.String())
+		err := e.api.masterState(client, &master, e.currentMesosMaster.String())
 		if err == nil {
-			leaderParts := strings.Split(master.Leader, "@")
+			address, ok := leaderAddress(master.Leader)
 			// Only return if the elected leader has not changed
-			if leaderParts[1] == e.currentMesosMaster.Host {
+			if ok && address == e.currentMesosMaster.Host {
+				e.api.setLeader(e.currentMesosMaster)
 				return master, nil
 			}
 		} else {
@@ -122,19 +366,20 @@ func (e *masterPoller) retrieveCurrentMasterState() (Master, error) {
 		}
 	}
 
-	for _, masterUrl := range e.config.MesosMasters {
+	for _, masterUrl := range masters {
 		var master Master
 
-		err := retrieveMasterState(e.httpClient, &master, masterUrl.String())
+		err := e.api.masterState(client, &master, masterUrl.String())
 		if err != nil {
 			log.Errorf("Unable to retrieve data from Mesos master '%s': %s", masterUrl, err)
 			continue
 		}
 
-		leaderParts := strings.Split(master.Leader, "@")
-		if leaderParts[1] == masterUrl.Host {
+		address, ok := leaderAddress(master.Leader)
+		if ok && address == masterUrl.Host {
 			log.Infof("Detected '%s' as the current Mesos master leader", master.Leader)
 			e.currentMesosMaster = masterUrl
+			e.api.setLeader(masterUrl)
 			return master, nil
 		}
 	}
@@ -142,72 +387,176 @@ func (e *masterPoller) retrieveCurrentMasterState() (Master, error) {
 	return Master{}, errors.New("Unable to retrieve current Master state")
 }
 
-func (e *masterPoller) poll(knownSlaves map[string]struct{}) {
-	availableSlaves := make(map[string]struct{})
+func containsUrl(urls []*url.URL, u *url.URL) bool {
+	for _, item := range urls {
+		if *item == *u {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Queries the leader that has been detected in ZooKeeper.
+func (e *masterPoller) retrieveDetectedMasterState(client *http.Client) (Master, error) {
+	var master Master
+
+	leader := e.detector.Leader()
+	if leader == nil {
+		return Master{}, errors.New("No Mesos master leader registered in ZooKeeper")
+	}
+
+	e.currentMesosMaster = leader
+
+	err := e.api.masterState(client, &master, leader.String())
+	if err != nil {
+		return Master{}, fmt.Errorf("Unable to retrieve data from Mesos master '%s': %s", leader, err)
+	}
+
+	e.api.setLeader(leader)
 
-	master, err := e.retrieveCurrentMasterState()
+	return master, nil
+}
+
+func (e *masterPoller) poll(ctx context.Context, knownSlaves map[string]Slave) {
+	master, err := e.retrieveCurrentMasterState(ctx)
+	e.leaderMetrics.update(master, err)
 	if err != nil {
 		log.Error(err)
 		return
 	}
 
-	e.tasksCounterVec.WithLabelValues("failed").Set(master.FailedTasks)
-	e.tasksCounterVec.WithLabelValues("finished").Set(master.FinishedTasks)
-	e.tasksCounterVec.WithLabelValues("killed").Set(master.KilledTasks)
-	e.tasksCounterVec.WithLabelValues("lost").Set(master.LostTasks)
-	e.tasksCounterVec.WithLabelValues("staged").Set(master.StagedTasks)
-	e.tasksCounterVec.WithLabelValues("started").Set(master.StartedTasks)
+	for status, value := range master.taskCounters() {
+		if value != nil {
+			e.tasksCounterVec.WithLabelValues(status).Set(*value)
+		}
+	}
 
 	e.handleFrameworks(master.Frameworks, e.frameworkResources)
 
-	// Start reading stats of a new slave.
-	for _, slave := range master.Slaves {
-		availableSlaves[slave.Pid] = struct{}{}
+	if e.discovery != nil {
+		e.discovery.update(master)
+	}
 
-		e.slaveResources.WithLabelValues(slave.Pid, "cpus").Set(slave.Resources.Cpus)
-		e.slaveResources.WithLabelValues(slave.Pid, "disk").Set(slave.Resources.Disk)
-		e.slaveResources.WithLabelValues(slave.Pid, "mem").Set(slave.Resources.Mem)
+	e.updateSlaves(knownSlaves, master.Slaves)
+}
 
-		_, ok := knownSlaves[slave.Pid]
-		if ok == false {
-			log.Debugf("Scraping slave '%s'", slave.Pid)
-			knownSlaves[slave.Pid] = struct{}{}
-			go slavePoller(e.httpClient, e.config, e.frameworkRegistry, slave)
+// Starts polling the slaves that joined the cluster and stops polling the ones that
+// left it.
+func (e *masterPoller) updateSlaves(knownSlaves map[string]Slave, current []Slave) {
+	availableSlaves := make(map[string]struct{})
+
+	slaves := []Slave{}
+	filteredSlaves := make(map[string]struct{})
+
+	for _, slave := range uniqueSlaves(current) {
+		if _, ok := e.filteredSlaves[slave.key()]; ok || e.config.Filters.keepSlave(slave) == false {
+			filteredSlaves[slave.key()] = struct{}{}
+			continue
 		}
+
+		slaves = append(slaves, slave)
+		availableSlaves[slave.key()] = struct{}{}
 	}
 
-	// Remove slaves that have gone offline.
-	for knownSlave, _ := range knownSlaves {
+	e.filteredSlaves = filteredSlaves
+
+	// Remove slaves that have gone offline, before a slave that re-registered
+	// with a new ID takes over their PID.
+	for knownSlave, known := range knownSlaves {
 		_, ok := availableSlaves[knownSlave]
 
 		if ok == false {
 			log.Debugf("Removing slave '%s'", knownSlave)
 
-			e.slaveResources.DeleteLabelValues(knownSlave, "cpus")
-			e.slaveResources.DeleteLabelValues(knownSlave, "disk")
-			e.slaveResources.DeleteLabelValues(knownSlave, "mem")
-
+			e.removeSlave(known)
 			delete(knownSlaves, knownSlave)
 		}
 	}
+
+	// Start reading stats of a new slave.
+	for _, slave := range slaves {
+		known, ok := knownSlaves[slave.key()]
+		if ok && known.Pid != slave.Pid {
+			// The poller is bound to the address and the labels of the slave
+			log.Infof("Slave '%s' moved from '%s' to '%s'", slave.key(), known.Pid, slave.Pid)
+
+			e.removeSlave(known)
+			ok = false
+		}
+
+		if ok {
+			// Keep the labels the slave has been discovered with
+			slave.Attributes = known.Attributes
+			slave.Hostname = known.Hostname
+		}
+
+		e.slaveResources.WithLabelValues(slaveResourcesLabelValues(e.config, slave, "cpus")...).Set(slave.Resources.Cpus)
+		e.slaveResources.WithLabelValues(slaveResourcesLabelValues(e.config, slave, "disk")...).Set(slave.Resources.Disk)
+		e.slaveResources.WithLabelValues(slaveResourcesLabelValues(e.config, slave, "mem")...).Set(slave.Resources.Mem)
+
+		if ok == false {
+			log.Debugf("Scraping slave '%s'", slave.Pid)
+			e.scheduler.add(slave)
+			knownSlaves[slave.key()] = slave
+		}
+	}
+}
+
+// Stops polling a slave and deletes the series of the slave.
+func (e *masterPoller) removeSlave(slave Slave) {
+	e.scheduler.remove(slave)
+	e.api.removeSlave(slave)
+
+	e.slaveResources.DeleteLabelValues(slaveResourcesLabelValues(e.config, slave, "cpus")...)
+	e.slaveResources.DeleteLabelValues(slaveResourcesLabelValues(e.config, slave, "disk")...)
+	e.slaveResources.DeleteLabelValues(slaveResourcesLabelValues(e.config, slave, "mem")...)
+}
+
+func slaveResourcesLabelNames(conf *Config) []string {
+	names := []string{"agent_id", "resource", "hostname"}
+	if conf.MesosSlavePidLabel {
+		names = append(names, "pid")
+	}
+
+	return append(names, conf.MesosSlaveAttributeLabels...)
+}
+
+func slaveResourcesLabelValues(conf *Config, slave Slave, resource string) []string {
+	values := []string{slave.Id, resource, slave.Hostname}
+	if conf.MesosSlavePidLabel {
+		values = append(values, slave.Pid)
+	}
+
+	return append(values, slave.attributeValues(conf.MesosSlaveAttributes)...)
 }
 
 func (e *masterPoller) handleFrameworks(frameworks []Framework, resources *prometheus.GaugeVec) {
 	knownFrameworks := e.frameworkRegistry.All()
 
 	availableFrameworks := make(map[string]struct{})
+	filteredFrameworks := make(map[string]struct{})
+	kept := []Framework{}
 
 	for _, framework := range frameworks {
+		if _, ok := e.filteredFrameworks[framework.Id]; ok || e.config.Filters.keepFramework(framework) == false {
+			filteredFrameworks[framework.Id] = struct{}{}
+			continue
+		}
+
 		e.frameworkResources.WithLabelValues(framework.Name, "cpus", "used").Set(framework.UsedResources.Cpus)
 		e.frameworkResources.WithLabelValues(framework.Name, "disk", "used").Set(framework.UsedResources.Disk)
 		e.frameworkResources.WithLabelValues(framework.Name, "mem", "used").Set(framework.UsedResources.Mem)
 
 		availableFrameworks[framework.Id] = struct{}{}
-
-		// Always set the framework because it contains the latest information about tasks
-		e.frameworkRegistry.Set(framework)
+		kept = append(kept, framework)
 	}
 
+	e.filteredFrameworks = filteredFrameworks
+
+	// Always replace the frameworks because they contain the latest information about tasks
+	e.frameworkRegistry.Replace(kept)
+
 	for _, knownFramework := range knownFrameworks {
 		_, ok := availableFrameworks[knownFramework.Id]
 		if ok == false {
@@ -217,26 +566,3 @@ func (e *masterPoller) handleFrameworks(frameworks []Framework, resources *prome
 		}
 	}
 }
-
-func retrieveMasterState(c *http.Client, master *Master, url string) error {
-	masterUrl := url + "/master/state.json"
-
-	resp, err := c.Get(masterUrl)
-	if err != nil {
-		return err
-	}
-
-	defer resp.Body.Close()
-
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-
-	err = json.Unmarshal(data, master)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
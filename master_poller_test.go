@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRetrieveCurrentMasterState(t *testing.T) {
@@ -24,13 +29,14 @@ func TestRetrieveCurrentMasterState(t *testing.T) {
 	masterUrl, _ = url.Parse(ts.URL)
 
 	m := masterPoller{
+		api: newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}),
 		config: &Config{
 			MesosMasters: []*url.URL{masterUrl},
 		},
 		httpClient: &http.Client{},
 	}
 
-	res, _ := m.retrieveCurrentMasterState()
+	res, _ := m.retrieveCurrentMasterState(context.Background())
 
 	require.Equal(t, "master1@"+masterUrl.Host, res.Leader)
 	require.Equal(t, masterUrl, m.currentMesosMaster)
@@ -75,17 +81,322 @@ func TestChangingMesosMasterLeader(t *testing.T) {
 	secondMasterUrl, _ = url.Parse(secondMaster.URL)
 
 	m := masterPoller{
+		api: newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}),
 		config: &Config{
 			MesosMasters: []*url.URL{firstMasterUrl, secondMasterUrl},
 		},
 		httpClient: &http.Client{},
 	}
 
-	m.retrieveCurrentMasterState()
-	res, _ := m.retrieveCurrentMasterState()
+	m.retrieveCurrentMasterState(context.Background())
+	res, _ := m.retrieveCurrentMasterState(context.Background())
 
 	require.Equal(t, "master2@"+secondMasterUrl.Host, res.Leader)
 	require.Equal(t, secondMasterUrl, m.currentMesosMaster)
 	require.Equal(t, 3, firstMasterReqCount)
 	require.Equal(t, 1, secondMasterReqCount)
 }
+
+// A master that stops responding is skipped once the request timeout passes.
+func TestRetrieveCurrentMasterStateTimeout(t *testing.T) {
+	var masterUrl *url.URL
+
+	done := make(chan struct{})
+
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer hanging.Close()
+	defer close(done)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := json.Marshal(Master{Leader: "master1@" + masterUrl.Host})
+
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	hangingUrl, _ := url.Parse(hanging.URL)
+	masterUrl, _ = url.Parse(ts.URL)
+
+	m := masterPoller{
+		api: newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}),
+		config: &Config{
+			MesosMasterRequestTimeout: 100 * time.Millisecond,
+			MesosMasters:              []*url.URL{hangingUrl, masterUrl},
+		},
+		httpClient: &http.Client{},
+	}
+
+	started := time.Now()
+
+	res, err := m.retrieveCurrentMasterState(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "master1@"+masterUrl.Host, res.Leader)
+	require.True(t, time.Since(started) < 5*time.Second)
+}
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := parsePortRanges("[31000-31002, 31005-31005]")
+
+	require.NoError(t, err)
+	require.Equal(t, []portRange{{begin: 31000, end: 31002}, {begin: 31005, end: 31005}}, ranges)
+	require.Equal(t, 4, countPorts(ranges))
+
+	ranges, err = parsePortRanges("")
+
+	require.NoError(t, err)
+	require.Len(t, ranges, 0)
+
+	_, err = parsePortRanges("[31002-31000]")
+	require.Error(t, err)
+}
+
+func TestSlaveIdentity(t *testing.T) {
+	var masterUrl *url.URL
+	var slaves []Slave
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := json.Marshal(Master{Leader: "master@" + masterUrl.Host, Slaves: slaves})
+
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	masterUrl, _ = url.Parse(ts.URL)
+
+	conf := &Config{
+		MesosMasters:            []*url.URL{masterUrl},
+		MesosSlaveConcurrency:   1,
+		MesosSlaveQueryInterval: time.Hour,
+	}
+
+	api := newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"})
+
+	m := masterPoller{
+		api:                api,
+		config:             conf,
+		frameworkRegistry:  NewFrameworkRegistry(0),
+		frameworkResources: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "framework_resources"}, []string{"name", "resource", "type"}),
+		httpClient:         &http.Client{},
+		leaderMetrics:      newLeaderMetrics(),
+		scheduler:          newSlaveScheduler(context.Background(), &http.Client{}, api, conf, NewFrameworkRegistry(0), nil),
+		slaveResources:     prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "slave_resources"}, slaveResourcesLabelNames(conf)),
+		tasksCounterVec:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tasks"}, []string{"status"}),
+	}
+
+	defer m.scheduler.Stop()
+
+	knownSlaves := make(map[string]Slave)
+
+	slaves = []Slave{{Active: true, Hostname: "slave1", Id: "s1", Pid: "slave(1)@10.0.0.1:5051"}}
+	m.poll(context.Background(), knownSlaves)
+
+	require.Len(t, knownSlaves, 1)
+	require.Equal(t, 3, countMetrics(m.slaveResources))
+
+	// A slave that restarted on another port is polled at its new PID
+	slaves = []Slave{{Active: true, Hostname: "slave1", Id: "s1", Pid: "slave(1)@10.0.0.1:5052"}}
+	m.poll(context.Background(), knownSlaves)
+
+	require.Len(t, knownSlaves, 1)
+	require.Equal(t, "slave(1)@10.0.0.1:5052", knownSlaves["s1"].Pid)
+	require.Equal(t, 3, countMetrics(m.slaveResources))
+
+	// A slave that re-registered with a new ID is only polled once
+	slaves = []Slave{
+		{Hostname: "slave1", Id: "s1", Pid: "slave(1)@10.0.0.1:5052"},
+		{Active: true, Hostname: "slave1", Id: "s2", Pid: "slave(1)@10.0.0.1:5052"},
+	}
+	m.poll(context.Background(), knownSlaves)
+
+	slave, ok := knownSlaves["s2"]
+	require.True(t, ok)
+	require.Len(t, knownSlaves, 1)
+	require.Equal(t, 3, countMetrics(m.slaveResources))
+	require.Len(t, m.scheduler.slaves, 1)
+
+	// Series are labelled with the ID of the slave and, for compatibility, its PID
+	require.Equal(t, []string{"s2", "slave1"}, slaveLabelValues(conf, slave))
+	require.Equal(t, []string{"s2", "slave1", "slave(1)@10.0.0.1:5052"}, slaveLabelValues(&Config{MesosSlavePidLabel: true}, slave))
+}
+
+func TestMasterPollerFilteredItems(t *testing.T) {
+	var masterUrl *url.URL
+
+	frameworks := []Framework{{Id: "fw1", Name: "marathon"}, {Id: "fw2", Name: "spark"}}
+	slaves := []Slave{
+		{Active: true, Id: "s1", Pid: "slave(1)@10.0.0.1:5051"},
+		{Active: true, Attributes: map[string]interface{}{"rack": "r2"}, Id: "s2", Pid: "slave(1)@10.0.0.2:5051"},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := json.Marshal(Master{Frameworks: frameworks, Leader: "master@" + masterUrl.Host, Slaves: slaves})
+
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	masterUrl, _ = url.Parse(ts.URL)
+
+	frameworkName, _ := newFilterRule("marathon", "")
+	slaveAttribute, _ := newFilterRule("", "rack:r2")
+	filters := newItemFilters(map[string]filterRule{"framework-name": frameworkName, "slave-attribute": slaveAttribute})
+
+	conf := &Config{
+		Filters:                 filters,
+		MesosMasters:            []*url.URL{masterUrl},
+		MesosSlaveConcurrency:   1,
+		MesosSlaveQueryInterval: time.Hour,
+	}
+
+	api := newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"})
+
+	m := masterPoller{
+		api:                api,
+		config:             conf,
+		frameworkRegistry:  NewFrameworkRegistry(0),
+		frameworkResources: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "framework_resources"}, []string{"name", "resource", "type"}),
+		httpClient:         &http.Client{},
+		leaderMetrics:      newLeaderMetrics(),
+		scheduler:          newSlaveScheduler(context.Background(), &http.Client{}, api, conf, NewFrameworkRegistry(0), nil),
+		slaveResources:     prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "slave_resources"}, slaveResourcesLabelNames(conf)),
+		tasksCounterVec:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tasks"}, []string{"status"}),
+	}
+
+	defer m.scheduler.Stop()
+
+	knownSlaves := make(map[string]Slave)
+
+	// Items are counted once while they stay filtered
+	m.poll(context.Background(), knownSlaves)
+	m.poll(context.Background(), knownSlaves)
+
+	require.Len(t, knownSlaves, 1)
+	require.Len(t, m.frameworkRegistry.All(), 1)
+	require.Equal(t, 1.0, filteredItems(t, filters, filteredFramework))
+	require.Equal(t, 1.0, filteredItems(t, filters, filteredSlave))
+
+	// and again once they come back after they disappeared
+	all := frameworks
+	frameworks = frameworks[:1]
+	slaves = slaves[:1]
+	m.poll(context.Background(), knownSlaves)
+
+	frameworks = all
+	slaves = append(slaves, Slave{Attributes: map[string]interface{}{"rack": "r2"}, Id: "s2", Pid: "slave(1)@10.0.0.2:5051"})
+	m.poll(context.Background(), knownSlaves)
+
+	require.Equal(t, 2.0, filteredItems(t, filters, filteredFramework))
+	require.Equal(t, 2.0, filteredItems(t, filters, filteredSlave))
+}
+
+func TestMasterPollerSubscribedSlaves(t *testing.T) {
+	var masterUrl *url.URL
+	var stateCount int32
+
+	// Every slave reports no tasks and counts how often it has been polled
+	slaveCounts := []*int32{new(int32), new(int32)}
+	slaveUrls := []*url.URL{}
+
+	for _, count := range slaveCounts {
+		count := count
+
+		slave := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(count, 1)
+			w.Write([]byte(`[]`))
+		}))
+		defer slave.Close()
+
+		slaveUrl, _ := url.Parse(slave.URL)
+		slaveUrls = append(slaveUrls, slaveUrl)
+	}
+
+	events := []string{
+		fmt.Sprintf(`{"type": "SUBSCRIBED", "subscribed": {"get_state": {"get_agents": {"agents": [{"active": true, "pid": "slave(1)@%s", "agent_info": {"id": {"value": "agent1"}}}]}}}}`, slaveUrls[0].Host),
+		fmt.Sprintf(`{"type": "AGENT_ADDED", "agent_added": {"agent": {"active": true, "pid": "slave(1)@%s", "agent_info": {"id": {"value": "agent2"}}}}}`, slaveUrls[1].Host),
+		`{"type": "AGENT_REMOVED", "agent_removed": {"agent_id": {"value": "agent1"}}}`,
+	}
+
+	done := make(chan struct{})
+	subscribed := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1" {
+			atomic.AddInt32(&stateCount, 1)
+
+			data, _ := json.Marshal(Master{
+				Leader: "master@" + masterUrl.Host,
+				Slaves: []Slave{{Active: true, Id: "agent1", Pid: "slave(1)@" + slaveUrls[0].Host}},
+			})
+
+			w.Write(data)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		// Events are only sent once the master has been polled
+		<-subscribed
+
+		for _, event := range events {
+			fmt.Fprintf(w, "%d\n%s", len(event), event)
+		}
+
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	masterUrl, _ = url.Parse(ts.URL)
+
+	conf := &Config{
+		MesosApiVersion:          apiVersionV0,
+		MesosMasterQueryInterval: time.Hour,
+		MesosMasters:             []*url.URL{masterUrl},
+		MesosSlaveConcurrency:    1,
+		MesosSlaveQueryInterval:  100 * time.Millisecond,
+		MesosSlaveScheme:         "http",
+	}
+
+	registry := NewFrameworkRegistry(0)
+
+	m := &masterPoller{
+		api:               newMesosApi(conf),
+		config:            conf,
+		frameworkRegistry: registry,
+		httpClient:        &http.Client{},
+		subscriber:        newMasterSubscriber(&http.Client{}, conf, nil, registry),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stopped := make(chan struct{})
+	go func() {
+		m.run(ctx)
+		close(stopped)
+	}()
+
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	require.True(t, waitFor(func() bool { return atomic.LoadInt32(slaveCounts[0]) > 0 }))
+
+	go m.subscriber.run(ctx)
+	close(subscribed)
+
+	// The slave that joined is polled without another query of the master
+	require.True(t, waitFor(func() bool { return atomic.LoadInt32(slaveCounts[1]) > 0 }))
+	require.Equal(t, int32(1), atomic.LoadInt32(&stateCount))
+}
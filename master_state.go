@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// A task as reported by /master/tasks, which names the framework of the task.
+type masterTask struct {
+	Task
+	FrameworkId string `json:"framework_id"`
+}
+
+// Retrieves the state of a master from /master/state. The response is decoded while
+// it is read and only the fields the exporter uses are kept, so that the state of a
+// large cluster is never held in memory as a whole.
+func retrieveMasterState(c *http.Client, master *Master, url string) error {
+	return getStream(c, url+"/master/state.json", func(dec *json.Decoder) error {
+		return decodeMasterState(dec, master)
+	})
+}
+
+// Retrieves the state of a master from /master/slaves, /master/frameworks and
+// /master/tasks, which is read pageSize tasks at a time. Unlike /master/state these
+// endpoints leave out completed frameworks and tasks. Whether the master leads and
+// the task counters are read from /metrics/snapshot - a master that does not lead
+// is reported without a leader. The time the master was elected and the total
+// number of staged and started tasks are not known. The snapshot only has gauges
+// of the tasks staging and starting right now, which are left out.
+func retrieveMasterStateSplit(c *http.Client, master *Master, base string, pageSize int) error {
+	var snapshot map[string]float64
+
+	err := getStream(c, base+"/metrics/snapshot", func(dec *json.Decoder) error {
+		return dec.Decode(&snapshot)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Masters that don't lead redirect the other endpoints to the leader
+	if snapshot["master/elected"] != 1 {
+		return nil
+	}
+
+	var version struct {
+		Version string
+	}
+
+	err = getStream(c, base+"/version", func(dec *json.Decoder) error {
+		return dec.Decode(&version)
+	})
+	if err != nil {
+		return err
+	}
+
+	masterUrl, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+
+	master.Leader = "master@" + masterUrl.Host
+	master.LeaderInfo.Hostname = masterUrl.Hostname()
+	master.Version = version.Version
+
+	for name, counter := range map[string]**float64{
+		"master/tasks_failed":   &master.FailedTasks,
+		"master/tasks_finished": &master.FinishedTasks,
+		"master/tasks_killed":   &master.KilledTasks,
+		"master/tasks_lost":     &master.LostTasks,
+	} {
+		if value, ok := snapshot[name]; ok {
+			*counter = &value
+		}
+	}
+
+	err = getStream(c, base+"/master/slaves", func(dec *json.Decoder) error {
+		return decodeObject(dec, master, func(name string) error {
+			if name == "slaves" {
+				return decodeSlaves(dec, master)
+			}
+
+			return skipValue(dec)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = getStream(c, base+"/master/frameworks", func(dec *json.Decoder) error {
+		return decodeObject(dec, master, func(name string) error {
+			if name == "frameworks" {
+				return decodeFrameworks(dec, master, false)
+			}
+
+			return skipValue(dec)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	tasks, err := retrieveTasks(c, base, pageSize)
+	if err != nil {
+		return err
+	}
+
+	for i := range master.Frameworks {
+		master.Frameworks[i].Tasks = tasks[master.Frameworks[i].Id]
+	}
+
+	return nil
+}
+
+// Retrieves the active tasks of all frameworks by the ID of their framework. Pages
+// are requested oldest task first, so that new tasks don't shift the following
+// pages. A task that still moves to the next page while the pages are read is
+// only kept once.
+func retrieveTasks(c *http.Client, base string, pageSize int) (map[string][]Task, error) {
+	tasks := make(map[string][]Task)
+	seen := make(map[string]struct{})
+
+	for offset := 0; ; offset = offset + pageSize {
+		count := 0
+
+		err := getStream(c, fmt.Sprintf("%s/master/tasks?limit=%d&offset=%d&order=asc", base, pageSize, offset), func(dec *json.Decoder) error {
+			return decodeObject(dec, tasks, func(name string) error {
+				if name != "tasks" {
+					return skipValue(dec)
+				}
+
+				return decodeArray(dec, []masterTask{}, func() error {
+					var task masterTask
+
+					err := dec.Decode(&task)
+					if err != nil {
+						return err
+					}
+
+					count = count + 1
+
+					// /master/state reports these tasks apart from the active ones
+					if _, ok := terminalTaskStates[task.State]; ok || task.State == "TASK_UNREACHABLE" {
+						return nil
+					}
+
+					key := task.FrameworkId + "/" + task.Id
+					if _, ok := seen[key]; ok {
+						return nil
+					}
+
+					seen[key] = struct{}{}
+					tasks[task.FrameworkId] = append(tasks[task.FrameworkId], task.Task)
+
+					return nil
+				})
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if count < pageSize {
+			return tasks, nil
+		}
+	}
+}
+
+// Requests a JSON document and decodes it with decode while it is read.
+func getStream(c *http.Client, url string, decode func(dec *json.Decoder) error) error {
+	resp, err := c.Get(url)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{resp.StatusCode, fmt.Sprintf("Unexpected status code %d from '%s'", resp.StatusCode, url)}
+	}
+
+	err = decode(json.NewDecoder(resp.Body))
+
+	// The document ended before a value that was expected
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// Decodes the fields of /master/state the exporter uses. Names are matched
+// case-insensitively like encoding/json does.
+func decodeMasterState(dec *json.Decoder, master *Master) error {
+	return decodeObject(dec, master, func(name string) error {
+		switch name {
+		case "elected_time":
+			return dec.Decode(&master.ElectedTime)
+		case "failed_tasks":
+			return dec.Decode(&master.FailedTasks)
+		case "finished_tasks":
+			return dec.Decode(&master.FinishedTasks)
+		case "frameworks":
+			return decodeFrameworks(dec, master, true)
+		case "killed_tasks":
+			return dec.Decode(&master.KilledTasks)
+		case "leader":
+			return dec.Decode(&master.Leader)
+		case "leader_info":
+			return dec.Decode(&master.LeaderInfo)
+		case "lost_tasks":
+			return dec.Decode(&master.LostTasks)
+		case "slaves":
+			return decodeSlaves(dec, master)
+		case "staged_tasks":
+			return dec.Decode(&master.StagedTasks)
+		case "started_tasks":
+			return dec.Decode(&master.StartedTasks)
+		case "version":
+			return dec.Decode(&master.Version)
+		}
+
+		return skipValue(dec)
+	})
+}
+
+// Frameworks are decoded one by one and only keep their tasks if withTasks is set.
+func decodeFrameworks(dec *json.Decoder, master *Master, withTasks bool) error {
+	return decodeArray(dec, master.Frameworks, func() error {
+		var framework Framework
+
+		err := decodeObject(dec, framework, func(name string) error {
+			switch name {
+			case "active":
+				return dec.Decode(&framework.Active)
+			case "id":
+				return dec.Decode(&framework.Id)
+			case "name":
+				return dec.Decode(&framework.Name)
+			case "role":
+				return dec.Decode(&framework.Role)
+			case "roles":
+				return dec.Decode(&framework.Roles)
+			case "tasks":
+				if withTasks == false {
+					break
+				}
+
+				return decodeArray(dec, framework.Tasks, func() error {
+					var task Task
+
+					err := dec.Decode(&task)
+					if err != nil {
+						return err
+					}
+
+					framework.Tasks = append(framework.Tasks, task)
+
+					return nil
+				})
+			case "used_resources":
+				return dec.Decode(&framework.UsedResources)
+			}
+
+			return skipValue(dec)
+		})
+		if err != nil {
+			return err
+		}
+
+		master.Frameworks = append(master.Frameworks, framework)
+
+		return nil
+	})
+}
+
+func decodeSlaves(dec *json.Decoder, master *Master) error {
+	return decodeArray(dec, master.Slaves, func() error {
+		var slave Slave
+
+		err := dec.Decode(&slave)
+		if err != nil {
+			return err
+		}
+
+		master.Slaves = append(master.Slaves, slave)
+
+		return nil
+	})
+}
+
+// Reads the members of an object. member is called with the lower-cased name of
+// each member and has to read its value. v is only used to describe the expected
+// value in errors. A null value is treated like an empty object.
+func decodeObject(dec *json.Decoder, v interface{}, member func(name string) error) error {
+	ok, err := openDelim(dec, '{', v)
+	if err != nil || ok == false {
+		return err
+	}
+
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		name, _ := token.(string)
+
+		err = member(strings.ToLower(name))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = dec.Token()
+
+	return err
+}
+
+// Reads the elements of an array with element. A null value is treated like an
+// empty array.
+func decodeArray(dec *json.Decoder, v interface{}, element func() error) error {
+	ok, err := openDelim(dec, '[', v)
+	if err != nil || ok == false {
+		return err
+	}
+
+	for dec.More() {
+		err = element()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = dec.Token()
+
+	return err
+}
+
+// Reads the opening delimiter of an object or array. Returns false for null.
+func openDelim(dec *json.Decoder, delim json.Delim, v interface{}) (bool, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return false, err
+	}
+
+	if token == nil {
+		return false, nil
+	}
+
+	if token != delim {
+		return false, &json.UnmarshalTypeError{Value: fmt.Sprint(token), Type: reflect.TypeOf(v), Offset: dec.InputOffset()}
+	}
+
+	return true, nil
+}
+
+// A value that is read without being kept.
+type ignoredValue struct{}
+
+func (*ignoredValue) UnmarshalJSON([]byte) error {
+	return nil
+}
+
+// Skips the next value. The elements of arrays and members of objects are skipped
+// one by one, so that only one of them is buffered at a time.
+func skipValue(dec *json.Decoder) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	delim, ok := token.(json.Delim)
+	if ok == false {
+		return nil
+	}
+
+	for dec.More() {
+		if delim == '{' {
+			_, err = dec.Token()
+			if err != nil {
+				return err
+			}
+		}
+
+		err = dec.Decode(&ignoredValue{})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = dec.Token()
+
+	return err
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// State of a cluster with the given number of slaves and frameworks that run tasks
+// tasks each, shaped like /master/state of Mesos with the fields the exporter does
+// not use - like completed tasks and the statuses of tasks.
+func syntheticMasterState(slaves int, frameworks int, tasks int) []byte {
+	resources := map[string]interface{}{"cpus": 0.5, "disk": 128.0, "gpus": 0.0, "mem": 256.0, "ports": "[31000-31000]"}
+
+	task := func(frameworkId string, i int, state string) map[string]interface{} {
+		id := fmt.Sprintf("%s-task-%d", frameworkId, i)
+
+		return map[string]interface{}{
+			"executor_id":  "",
+			"framework_id": frameworkId,
+			"id":           id,
+			"labels":       []interface{}{map[string]interface{}{"key": "team", "value": "infra"}},
+			"name":         fmt.Sprintf("task-%d", i),
+			"resources":    resources,
+			"slave_id":     fmt.Sprintf("slave-%d", i%slaves),
+			"state":        state,
+			"statuses": []interface{}{
+				map[string]interface{}{
+					"container_status": map[string]interface{}{
+						"container_id":  map[string]interface{}{"value": id + "-container"},
+						"network_infos": []interface{}{map[string]interface{}{"ip_addresses": []interface{}{map[string]interface{}{"ip_address": "10.0.0.1", "protocol": "IPv4"}}}},
+					},
+					"state":     state,
+					"timestamp": 1500000000.123,
+				},
+			},
+		}
+	}
+
+	state := map[string]interface{}{
+		"activated_slaves": float64(slaves),
+		"elected_time":     1500000000.0,
+		"failed_tasks":     1.0,
+		"finished_tasks":   2.0,
+		"flags":            map[string]interface{}{"quorum": "2", "work_dir": "/var/lib/mesos"},
+		"leader":           "master@10.0.0.1:5050",
+		"leader_info":      map[string]interface{}{"hostname": "master1", "id": "master-1", "pid": "master@10.0.0.1:5050", "version": "1.4.0"},
+		"version":          "1.4.0",
+	}
+
+	slaveItems := []interface{}{}
+	for i := 0; i < slaves; i++ {
+		slaveItems = append(slaveItems, map[string]interface{}{
+			"active":                  true,
+			"attributes":              map[string]interface{}{"rack": fmt.Sprintf("r%d", i%10)},
+			"hostname":                fmt.Sprintf("slave%d", i),
+			"id":                      fmt.Sprintf("slave-%d", i),
+			"offered_resources":       resources,
+			"pid":                     fmt.Sprintf("slave(1)@10.1.%d.%d:5051", i/256, i%256),
+			"registered_time":         1500000000.0,
+			"reserved_resources_full": map[string]interface{}{"*": []interface{}{resources, resources}},
+			"resources":               resources,
+			"used_resources":          resources,
+			"version":                 "1.4.0",
+		})
+	}
+
+	state["slaves"] = slaveItems
+
+	frameworkItems := []interface{}{}
+	for i := 0; i < frameworks; i++ {
+		id := fmt.Sprintf("framework-%d", i)
+
+		active := []interface{}{}
+		completed := []interface{}{}
+		for j := 0; j < tasks; j++ {
+			active = append(active, task(id, j, "TASK_RUNNING"))
+			completed = append(completed, task(id, tasks+j, "TASK_FINISHED"))
+		}
+
+		frameworkItems = append(frameworkItems, map[string]interface{}{
+			"active":          true,
+			"completed_tasks": completed,
+			"executors":       []interface{}{},
+			"hostname":        "scheduler1",
+			"id":              id,
+			"name":            fmt.Sprintf("framework%d", i),
+			"offers":          []interface{}{},
+			"role":            "*",
+			"tasks":           active,
+			"used_resources":  resources,
+		})
+	}
+
+	state["frameworks"] = frameworkItems
+	state["completed_frameworks"] = frameworkItems
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+func TestDecodeMasterState(t *testing.T) {
+	data := syntheticMasterState(3, 2, 4)
+
+	var expected Master
+	require.NoError(t, json.Unmarshal(data, &expected))
+
+	var master Master
+	require.NoError(t, decodeMasterState(json.NewDecoder(bytes.NewReader(data)), &master))
+
+	require.Equal(t, expected, master)
+	require.Len(t, master.Slaves, 3)
+	require.Len(t, master.Frameworks, 2)
+	require.Len(t, master.Frameworks[0].Tasks, 4)
+	require.Equal(t, "infra", master.Frameworks[0].Tasks[0].Labels[0].Value)
+
+	// Names are matched regardless of their case and null values are left out
+	master = Master{}
+	require.NoError(t, decodeMasterState(json.NewDecoder(bytes.NewReader([]byte(`{"Leader": "master@10.0.0.1:5050", "Slaves": null, "Frameworks": [{"Id": "fw1", "Tasks": null}]}`))), &master))
+	require.Equal(t, "master@10.0.0.1:5050", master.Leader)
+	require.Len(t, master.Frameworks, 1)
+
+	for _, invalid := range []string{`[]`, `{"slaves": {}}`, `{"frameworks": [{"tasks": [1]}]}`, `{"leader": "master@`, `{"flags": {"quorum": }}`, ``} {
+		err := decodeMasterState(json.NewDecoder(bytes.NewReader([]byte(invalid))), &Master{})
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestRetrieveMasterStateSplit(t *testing.T) {
+	tasks := []string{
+		`{"id": "web.1", "framework_id": "fw1", "name": "web", "state": "TASK_RUNNING"}`,
+		`{"id": "web.0", "framework_id": "fw1", "name": "web", "state": "TASK_FINISHED"}`,
+		`{"id": "job.1", "framework_id": "fw2", "name": "job", "state": "TASK_STAGING"}`,
+		`{"id": "web.2", "framework_id": "fw1", "name": "web", "state": "TASK_RUNNING"}`,
+		`{"id": "web.3", "framework_id": "fw1", "name": "web", "state": "TASK_UNREACHABLE"}`,
+	}
+
+	elected := "1"
+	stateCount := 0
+	taskPages := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metrics/snapshot":
+			w.Write([]byte(`{"master/elected": ` + elected + `, "master/tasks_failed": 3, "master/tasks_running": 2, "master/tasks_staging": 1}`))
+		case "/version":
+			w.Write([]byte(`{"version": "1.0.0"}`))
+		case "/master/slaves":
+			w.Write([]byte(`{"slaves": [{"id": "s1", "pid": "slave(1)@10.0.0.2:5051", "hostname": "slave1", "active": true}], "recovered_slaves": []}`))
+		case "/master/frameworks":
+			w.Write([]byte(`{
+				"frameworks": [
+					{"id": "fw1", "name": "marathon", "role": "*", "tasks": [{"id": "web.1"}], "completed_tasks": [{"id": "web.0"}]},
+					{"id": "fw2", "name": "chronos", "role": "*"}
+				],
+				"completed_frameworks": [{"id": "fw0", "name": "old"}]
+			}`))
+		case "/master/tasks":
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			require.Equal(t, "asc", r.URL.Query().Get("order"))
+
+			taskPages = taskPages + 1
+
+			page := []json.RawMessage{}
+			for i := offset; i < offset+limit && i < len(tasks); i++ {
+				page = append(page, json.RawMessage(tasks[i]))
+			}
+
+			data, _ := json.Marshal(map[string]interface{}{"tasks": page})
+			w.Write(data)
+		default:
+			stateCount = stateCount + 1
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	api := newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosMasterEndpoints: masterEndpointsSplit, MesosMasterTasksPageSize: 2})
+
+	var master Master
+	require.NoError(t, api.masterState(&http.Client{}, &master, ts.URL))
+
+	masterUrl, _ := url.Parse(ts.URL)
+
+	require.Equal(t, "master@"+masterUrl.Host, master.Leader)
+	require.Equal(t, "1.0.0", master.Version)
+	require.Equal(t, 3.0, *master.FailedTasks)
+	require.Nil(t, master.StagedTasks)
+	require.Nil(t, master.StartedTasks)
+	require.Nil(t, master.ElectedTime)
+
+	require.Len(t, master.Slaves, 1)
+	require.Equal(t, "s1", master.Slaves[0].Id)
+
+	// Completed frameworks and tasks are left out
+	require.Len(t, master.Frameworks, 2)
+	require.Equal(t, []Task{{Id: "web.1", Name: "web", State: "TASK_RUNNING"}, {Id: "web.2", Name: "web", State: "TASK_RUNNING"}}, master.Frameworks[0].Tasks)
+	require.Equal(t, []Task{{Id: "job.1", Name: "job", State: "TASK_STAGING"}}, master.Frameworks[1].Tasks)
+
+	require.Equal(t, 3, taskPages)
+	require.Equal(t, 0, stateCount)
+
+	// A master that does not lead is reported without a leader
+	elected = "0"
+	taskPages = 0
+
+	master = Master{}
+	require.NoError(t, api.masterState(&http.Client{}, &master, ts.URL))
+	require.Equal(t, "", master.Leader)
+	require.Len(t, master.Slaves, 0)
+	require.Equal(t, 0, taskPages)
+}
+
+var benchmarkMasterState []byte
+
+// State of a large cluster with 1000 slaves and 20000 active tasks, generated once
+// for all benchmarks.
+func largeMasterState(b *testing.B) []byte {
+	if benchmarkMasterState == nil {
+		benchmarkMasterState = syntheticMasterState(1000, 20, 1000)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkMasterState)))
+	b.ResetTimer()
+
+	return benchmarkMasterState
+}
+
+func BenchmarkDecodeMasterState(b *testing.B) {
+	data := largeMasterState(b)
+
+	for i := 0; i < b.N; i++ {
+		var master Master
+
+		err := decodeMasterState(json.NewDecoder(bytes.NewReader(data)), &master)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Reads the whole response before decoding it, like the exporter did before it
+// decoded /master/state as a stream.
+func BenchmarkUnmarshalMasterState(b *testing.B) {
+	data := largeMasterState(b)
+
+	for i := 0; i < b.N; i++ {
+		var master Master
+
+		data, err := ioutil.ReadAll(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		err = json.Unmarshal(data, &master)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
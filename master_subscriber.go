@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	subscribeHeartbeatInterval = 15 * time.Second
+	subscribeMissedHeartbeats  = 3
+	subscribeRetryInterval     = 1 * time.Second
+)
+
+// Task states after which Mesos does not send further updates.
+var terminalTaskStates = map[string]struct{}{
+	"TASK_DROPPED":          struct{}{},
+	"TASK_ERROR":            struct{}{},
+	"TASK_FAILED":           struct{}{},
+	"TASK_FINISHED":         struct{}{},
+	"TASK_GONE":             struct{}{},
+	"TASK_GONE_BY_OPERATOR": struct{}{},
+	"TASK_KILLED":           struct{}{},
+	"TASK_LOST":             struct{}{},
+}
+
+// An event of the SUBSCRIBE call of the v1 Operator API. Only the field that
+// belongs to the type of the event is set.
+type v1Event struct {
+	AgentAdded struct {
+		Agent v1Agent
+	} `json:"agent_added"`
+	AgentRemoved struct {
+		AgentId v1Value `json:"agent_id"`
+	} `json:"agent_removed"`
+	FrameworkAdded struct {
+		Framework v1Framework
+	} `json:"framework_added"`
+	FrameworkRemoved struct {
+		FrameworkInfo struct {
+			Id v1Value
+		} `json:"framework_info"`
+	} `json:"framework_removed"`
+	FrameworkUpdated struct {
+		Framework v1Framework
+	} `json:"framework_updated"`
+	Subscribed struct {
+		GetState                 v1State `json:"get_state"`
+		HeartbeatIntervalSeconds float64 `json:"heartbeat_interval_seconds"`
+	}
+	TaskAdded struct {
+		Task v1Task
+	} `json:"task_added"`
+	TaskUpdated struct {
+		FrameworkId v1Value `json:"framework_id"`
+		State       string
+		Status      struct {
+			TaskId v1Value `json:"task_id"`
+		}
+	} `json:"task_updated"`
+	Type string
+}
+
+// Follows the event stream of the Mesos master leader. Keeps the framework registry
+// and the set of agents up to date between two polls of the master and counts the
+// transitions of tasks from one state to another. Frameworks that are filtered are
+// left out of the registry and their tasks are not counted. The last known state
+// of each task is kept until the task reaches a terminal state or its framework or
+// agent is removed.
+type masterSubscriber struct {
+	agents             map[string]Slave
+	changes            chan struct{}
+	config             *Config
+	detector           *zkMasterDetector
+	filteredFrameworks map[string]struct{}
+	frameworkRegistry  *frameworkRegistry
+	httpClient         *http.Client
+	mutex              *sync.Mutex
+	tasks              map[string]subscribedTask
+	transitions        *prometheus.CounterVec
+}
+
+type subscribedTask struct {
+	agentId string
+	state   string
+}
+
+// Agents currently registered with the master, ordered by ID.
+func (s *masterSubscriber) Agents() []Slave {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	agents := []Slave{}
+	for _, agent := range s.agents {
+		agents = append(agents, agent)
+	}
+
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].Id < agents[j].Id
+	})
+
+	return agents
+}
+
+// Follows the event stream until ctx is cancelled.
+func (s *masterSubscriber) run(ctx context.Context) {
+	for {
+		err := s.subscribe(ctx)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Errorf("Lost subscription to events of the Mesos master: %s", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(subscribeRetryInterval):
+		}
+	}
+}
+
+// Masters to subscribe to. Masters that are not the leader redirect to the leader.
+func (s *masterSubscriber) masterUrls() ([]*url.URL, error) {
+	if s.detector == nil {
+		return s.config.masters(), nil
+	}
+
+	leader := s.detector.Leader()
+	if leader == nil {
+		return nil, errors.New("No Mesos master leader registered in ZooKeeper")
+	}
+
+	return []*url.URL{leader}, nil
+}
+
+// Subscribes to the first master that accepts the call and consumes events until
+// the stream breaks or ctx is cancelled.
+func (s *masterSubscriber) subscribe(ctx context.Context) error {
+	masters, err := s.masterUrls()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for _, master := range masters {
+		var resp *http.Response
+
+		resp, err = s.connect(ctx, master.String())
+		if err != nil {
+			log.Warnf("Unable to subscribe to events of Mesos master '%s': %s", master, err)
+			continue
+		}
+
+		defer resp.Body.Close()
+
+		log.Infof("Subscribed to events of Mesos master '%s'", master)
+
+		return s.consume(resp.Body, cancel)
+	}
+
+	return fmt.Errorf("No Mesos master accepted the subscription: %s", err)
+}
+
+func (s *masterSubscriber) connect(ctx context.Context, master string) (*http.Response, error) {
+	body, err := json.Marshal(map[string]string{"type": "SUBSCRIBE"})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", master+"/api/v1", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+
+		data, _ := ioutil.ReadAll(resp.Body)
+
+		return nil, fmt.Errorf("Unexpected status code %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	return resp, nil
+}
+
+// Reads events until the stream ends. The stream is cancelled if the master
+// misses several heartbeats in a row.
+func (s *masterSubscriber) consume(body io.Reader, cancel context.CancelFunc) error {
+	r := bufio.NewReader(body)
+
+	timeout := subscribeMissedHeartbeats * subscribeHeartbeatInterval
+
+	watchdog := time.AfterFunc(timeout, cancel)
+	defer watchdog.Stop()
+
+	for {
+		record, err := readRecordIO(r, s.config.maxResponseSize())
+		if err == io.EOF {
+			return errors.New("Event stream closed by the Mesos master")
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var event v1Event
+
+		err = json.Unmarshal(record, &event)
+		if err != nil {
+			return err
+		}
+
+		if event.Type == "SUBSCRIBED" && event.Subscribed.HeartbeatIntervalSeconds > 0 {
+			interval := time.Duration(event.Subscribed.HeartbeatIntervalSeconds * float64(time.Second))
+			timeout = subscribeMissedHeartbeats * interval
+		}
+
+		watchdog.Reset(timeout)
+
+		s.handle(event)
+	}
+}
+
+func (s *masterSubscriber) handle(event v1Event) {
+	switch event.Type {
+	case "SUBSCRIBED":
+		s.reset(event.Subscribed.GetState)
+	case "TASK_ADDED":
+		s.addTask(event.TaskAdded.Task)
+	case "TASK_UPDATED":
+		u := event.TaskUpdated
+		s.updateTask(u.FrameworkId.Value, u.Status.TaskId.Value, u.State)
+	case "AGENT_ADDED":
+		agent := convertAgentV1(event.AgentAdded.Agent)
+
+		s.mutex.Lock()
+		s.agents[agent.Id] = agent
+		s.mutex.Unlock()
+
+		s.notify()
+	case "AGENT_REMOVED":
+		s.mutex.Lock()
+		delete(s.agents, event.AgentRemoved.AgentId.Value)
+		s.forgetTasks(func(key string, task subscribedTask) bool {
+			return task.agentId == event.AgentRemoved.AgentId.Value
+		})
+		s.mutex.Unlock()
+
+		s.notify()
+	case "FRAMEWORK_ADDED":
+		s.setFramework(convertFrameworkV1(event.FrameworkAdded.Framework))
+	case "FRAMEWORK_UPDATED":
+		s.setFramework(convertFrameworkV1(event.FrameworkUpdated.Framework))
+	case "FRAMEWORK_REMOVED":
+		s.removeFramework(event.FrameworkRemoved.FrameworkInfo.Id.Value)
+	}
+}
+
+// Replaces all state with the snapshot the master sends when subscribing. Tasks
+// in the snapshot are not counted as transitions.
+func (s *masterSubscriber) reset(state v1State) {
+	kept := []Framework{}
+	filtered := make(map[string]struct{})
+
+	for _, framework := range state.frameworks() {
+		if s.config.Filters.matchFramework(framework) == false {
+			filtered[framework.Id] = struct{}{}
+			continue
+		}
+
+		kept = append(kept, framework)
+	}
+
+	s.frameworkRegistry.Replace(kept)
+
+	s.mutex.Lock()
+
+	s.filteredFrameworks = filtered
+
+	s.agents = make(map[string]Slave)
+	for _, agent := range state.slaves() {
+		s.agents[agent.Id] = agent
+	}
+
+	s.tasks = make(map[string]subscribedTask)
+	for _, task := range state.GetTasks.Tasks {
+		if _, ok := filtered[task.FrameworkId.Value]; ok {
+			continue
+		}
+
+		s.tasks[task.FrameworkId.Value+"/"+task.TaskId.Value] = subscribedTask{agentId: task.AgentId.Value, state: task.State}
+	}
+
+	s.mutex.Unlock()
+
+	s.notify()
+}
+
+// Updates a framework but keeps the tasks that are already known. A framework that
+// is filtered, e.g. after it changed its roles, is removed instead. The filtered
+// frameworks are only counted by the master poller.
+func (s *masterSubscriber) setFramework(framework Framework) {
+	keep := s.config.Filters.matchFramework(framework)
+
+	s.mutex.Lock()
+	if keep {
+		delete(s.filteredFrameworks, framework.Id)
+	} else {
+		s.filteredFrameworks[framework.Id] = struct{}{}
+		s.forgetFrameworkTasks(framework.Id)
+	}
+	s.mutex.Unlock()
+
+	if keep == false {
+		s.frameworkRegistry.Delete(framework.Id)
+		return
+	}
+
+	known, err := s.frameworkRegistry.Get(framework.Id)
+	if err == nil {
+		framework.Tasks = known.Tasks
+	}
+
+	s.frameworkRegistry.Set(framework)
+}
+
+func (s *masterSubscriber) removeFramework(id string) {
+	s.frameworkRegistry.Delete(id)
+
+	s.mutex.Lock()
+	delete(s.filteredFrameworks, id)
+	s.forgetFrameworkTasks(id)
+	s.mutex.Unlock()
+}
+
+func (s *masterSubscriber) addTask(t v1Task) {
+	if s.filtered(t.FrameworkId.Value) {
+		return
+	}
+
+	framework, err := s.frameworkRegistry.Get(t.FrameworkId.Value)
+	if err != nil {
+		framework = Framework{Id: t.FrameworkId.Value}
+	}
+
+	framework.Tasks = append(append([]Task{}, framework.Tasks...), convertTaskV1(t))
+	s.frameworkRegistry.Set(framework)
+
+	s.transition(framework, t.TaskId.Value, t.AgentId.Value, t.State)
+}
+
+// Counts the new state of a task and removes tasks that reached a terminal state.
+func (s *masterSubscriber) updateTask(frameworkId string, taskId string, state string) {
+	if s.filtered(frameworkId) {
+		return
+	}
+
+	framework, err := s.frameworkRegistry.Get(frameworkId)
+	if err != nil {
+		framework = Framework{Id: frameworkId}
+	}
+
+	s.transition(framework, taskId, "", state)
+
+	if _, ok := terminalTaskStates[state]; ok == false {
+		return
+	}
+
+	s.mutex.Lock()
+	delete(s.tasks, frameworkId+"/"+taskId)
+	s.mutex.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	tasks := []Task{}
+	for _, task := range framework.Tasks {
+		if task.Id != taskId {
+			tasks = append(tasks, task)
+		}
+	}
+
+	framework.Tasks = tasks
+	s.frameworkRegistry.Set(framework)
+}
+
+// Must be called with the mutex held.
+func (s *masterSubscriber) forgetTasks(forget func(key string, task subscribedTask) bool) {
+	for key, task := range s.tasks {
+		if forget(key, task) {
+			delete(s.tasks, key)
+		}
+	}
+}
+
+// Must be called with the mutex held.
+func (s *masterSubscriber) forgetFrameworkTasks(frameworkId string) {
+	s.forgetTasks(func(key string, task subscribedTask) bool {
+		return strings.HasPrefix(key, frameworkId+"/")
+	})
+}
+
+func (s *masterSubscriber) filtered(frameworkId string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, ok := s.filteredFrameworks[frameworkId]
+
+	return ok
+}
+
+// Status updates that don't change the state, e.g. of health checks, are not counted.
+// The agent of a task is kept if the event doesn't name it.
+func (s *masterSubscriber) transition(framework Framework, taskId string, agentId string, state string) {
+	key := framework.Id + "/" + taskId
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	task := s.tasks[key]
+	if agentId != "" {
+		task.agentId = agentId
+	}
+
+	if task.state == state {
+		s.tasks[key] = task
+		return
+	}
+
+	task.state = state
+	s.tasks[key] = task
+
+	name := framework.Name
+	if name == "" {
+		name = framework.Id
+	}
+
+	s.transitions.WithLabelValues(name, strings.ToLower(strings.TrimPrefix(state, "TASK_"))).Inc()
+}
+
+// Notify without blocking - a pending notification is enough
+func (s *masterSubscriber) notify() {
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
+
+// Reads a record in RecordIO format: the length of the record in bytes followed
+// by a newline and the record itself. Records larger than limit are rejected,
+// unless limit is 0. The record is read as it arrives rather than allocated by
+// its length up front, so that a corrupt length does not exhaust the memory.
+func readRecordIO(r *bufio.Reader, limit int64) ([]byte, error) {
+	header, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && header != "" {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(header), 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("Invalid RecordIO header '%s'", strings.TrimSpace(header))
+	}
+
+	if limit > 0 && size > limit {
+		return nil, fmt.Errorf("RecordIO record of %d bytes exceeds the maximum size of %d bytes", size, limit)
+	}
+
+	var record bytes.Buffer
+
+	n, err := io.CopyN(&record, r, size)
+	if err == io.EOF && n < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return record.Bytes(), nil
+}
+
+func newMasterSubscriber(c *http.Client, conf *Config, detector *zkMasterDetector, frameworkRegistry *frameworkRegistry) *masterSubscriber {
+	return &masterSubscriber{
+		agents:             make(map[string]Slave),
+		changes:            make(chan struct{}, 1),
+		config:             conf,
+		detector:           detector,
+		filteredFrameworks: make(map[string]struct{}),
+		frameworkRegistry:  frameworkRegistry,
+		httpClient:         c,
+		mutex:              &sync.Mutex{},
+		tasks:              make(map[string]subscribedTask),
+		transitions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Help:      "Number of times a task entered a state as reported by the event stream of the Mesos master",
+				Name:      "state_transitions",
+				Namespace: namespace,
+				Subsystem: subsystem,
+			},
+			[]string{"framework", "state"}),
+	}
+}
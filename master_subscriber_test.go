@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var fakeMasterEvents = []string{
+	`{
+		"type": "SUBSCRIBED",
+		"subscribed": {
+			"heartbeat_interval_seconds": 15,
+			"get_state": {
+				"get_tasks": {
+					"tasks": [{
+						"name": "redis",
+						"task_id": {"value": "task1"},
+						"framework_id": {"value": "fw1"},
+						"agent_id": {"value": "agent1"},
+						"state": "TASK_RUNNING"
+					}]
+				},
+				"get_frameworks": {
+					"frameworks": [{"active": true, "framework_info": {"id": {"value": "fw1"}, "name": "marathon"}}]
+				},
+				"get_agents": {
+					"agents": [{"pid": "slave(1)@10.0.0.1:5051", "agent_info": {"id": {"value": "agent1"}, "hostname": "agent1"}}]
+				}
+			}
+		}
+	}`,
+	`{"type": "HEARTBEAT"}`,
+	`{
+		"type": "TASK_ADDED",
+		"task_added": {
+			"task": {
+				"name": "nginx",
+				"task_id": {"value": "task2"},
+				"framework_id": {"value": "fw1"},
+				"agent_id": {"value": "agent1"},
+				"state": "TASK_STAGING"
+			}
+		}
+	}`,
+	`{"type": "TASK_UPDATED", "task_updated": {"framework_id": {"value": "fw1"}, "state": "TASK_RUNNING", "status": {"task_id": {"value": "task2"}}}}`,
+	`{"type": "TASK_UPDATED", "task_updated": {"framework_id": {"value": "fw1"}, "state": "TASK_RUNNING", "status": {"task_id": {"value": "task2"}}}}`,
+	`{"type": "TASK_UPDATED", "task_updated": {"framework_id": {"value": "fw1"}, "state": "TASK_FINISHED", "status": {"task_id": {"value": "task1"}}}}`,
+	`{"type": "FRAMEWORK_ADDED", "framework_added": {"framework": {"active": true, "framework_info": {"id": {"value": "fw2"}, "name": "chronos"}}}}`,
+	`{"type": "AGENT_ADDED", "agent_added": {"agent": {"pid": "slave(1)@10.0.0.2:5051", "agent_info": {"id": {"value": "agent2"}, "hostname": "agent2"}}}}`,
+	`{"type": "AGENT_REMOVED", "agent_removed": {"agent_id": {"value": "agent1"}}}`,
+}
+
+// Serves the given events in RecordIO format on SUBSCRIBE and keeps the stream
+// open until the test ends.
+func newFakeSubscribeServer(t *testing.T, events []string, done <-chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v1", r.URL.Path)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		for _, event := range events {
+			fmt.Fprintf(w, "%d\n%s", len(event), event)
+		}
+
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+}
+
+func counterValue(s *masterSubscriber, framework string, state string) float64 {
+	m := &dto.Metric{}
+	s.transitions.WithLabelValues(framework, state).Write(m)
+
+	return m.GetCounter().GetValue()
+}
+
+func TestReadRecordIO(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("5\nhello0\n3\nabc"))
+
+	for _, expected := range []string{"hello", "", "abc"} {
+		record, err := readRecordIO(r, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(record))
+	}
+
+	_, err := readRecordIO(bufio.NewReader(strings.NewReader("x\nabc")), 0)
+	require.Error(t, err)
+
+	_, err = readRecordIO(bufio.NewReader(strings.NewReader("5\nabc")), 0)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// A corrupt length must not allocate the whole record up front
+	_, err = readRecordIO(bufio.NewReader(strings.NewReader("9000000000000\nabc")), 0)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	_, err = readRecordIO(bufio.NewReader(strings.NewReader("5\nhello")), 4)
+	require.Error(t, err)
+
+	record, err := readRecordIO(bufio.NewReader(strings.NewReader("5\nhello")), 5)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(record))
+}
+
+func TestMasterSubscriber(t *testing.T) {
+	done := make(chan struct{})
+
+	ts := newFakeSubscribeServer(t, fakeMasterEvents, done)
+	defer ts.Close()
+	defer close(done)
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	unavailableUrl, _ := url.Parse(unavailable.URL)
+	masterUrl, _ := url.Parse(ts.URL)
+
+	registry := NewFrameworkRegistry(0)
+
+	s := newMasterSubscriber(&http.Client{}, &Config{MesosMasters: []*url.URL{unavailableUrl, masterUrl}}, nil, registry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go s.run(ctx)
+
+	require.True(t, waitFor(func() bool {
+		agents := s.Agents()
+		return len(agents) == 1 && agents[0].Id == "agent2"
+	}))
+
+	require.Equal(t, "slave(1)@10.0.0.2:5051", s.Agents()[0].Pid)
+
+	// Tasks of the snapshot are not counted, repeated updates of the same state neither
+	require.Equal(t, 1.0, counterValue(s, "marathon", "staging"))
+	require.Equal(t, 1.0, counterValue(s, "marathon", "running"))
+	require.Equal(t, 1.0, counterValue(s, "marathon", "finished"))
+
+	fw1, err := registry.Get("fw1")
+	require.NoError(t, err)
+	require.Equal(t, "marathon", fw1.Name)
+	require.Len(t, fw1.Tasks, 1)
+	require.Equal(t, "task2", fw1.Tasks[0].Id)
+
+	fw2, err := registry.Get("fw2")
+	require.NoError(t, err)
+	require.Equal(t, "chronos", fw2.Name)
+
+	// The master poller is asked to pick up the new agent
+	select {
+	case <-s.changes:
+	default:
+		t.Fatal("Expected a notification about changed agents")
+	}
+}
+
+func TestMasterSubscriberFilters(t *testing.T) {
+	events := []string{
+		`{
+			"type": "SUBSCRIBED",
+			"subscribed": {
+				"get_state": {
+					"get_tasks": {
+						"tasks": [{"task_id": {"value": "job1"}, "framework_id": {"value": "fw3"}, "state": "TASK_RUNNING"}]
+					},
+					"get_frameworks": {
+						"frameworks": [
+							{"active": true, "framework_info": {"id": {"value": "fw1"}, "name": "marathon"}},
+							{"active": true, "framework_info": {"id": {"value": "fw3"}, "name": "spark"}}
+						]
+					}
+				}
+			}
+		}`,
+		`{"type": "FRAMEWORK_ADDED", "framework_added": {"framework": {"active": true, "framework_info": {"id": {"value": "fw4"}, "name": "spark"}}}}`,
+		`{"type": "TASK_ADDED", "task_added": {"task": {"task_id": {"value": "job2"}, "framework_id": {"value": "fw4"}, "state": "TASK_STAGING"}}}`,
+		`{"type": "TASK_UPDATED", "task_updated": {"framework_id": {"value": "fw3"}, "state": "TASK_FINISHED", "status": {"task_id": {"value": "job1"}}}}`,
+		`{"type": "FRAMEWORK_ADDED", "framework_added": {"framework": {"active": true, "framework_info": {"id": {"value": "fw2"}, "name": "chronos"}}}}`,
+	}
+
+	done := make(chan struct{})
+
+	ts := newFakeSubscribeServer(t, events, done)
+	defer ts.Close()
+	defer close(done)
+
+	masterUrl, _ := url.Parse(ts.URL)
+
+	frameworkName, _ := newFilterRule("marathon|chronos", "")
+	filters := newItemFilters(map[string]filterRule{"framework-name": frameworkName})
+
+	registry := NewFrameworkRegistry(0)
+
+	s := newMasterSubscriber(&http.Client{}, &Config{Filters: filters, MesosMasters: []*url.URL{masterUrl}}, nil, registry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go s.run(ctx)
+
+	require.True(t, waitFor(func() bool {
+		_, err := registry.Get("fw2")
+		return err == nil
+	}))
+
+	require.Len(t, registry.All(), 2)
+
+	for _, id := range []string{"fw3", "fw4"} {
+		_, err := registry.Get(id)
+		require.Error(t, err, id)
+	}
+
+	// Tasks of filtered frameworks are not counted and filtered frameworks only
+	// by the master poller
+	require.Equal(t, 0.0, counterValue(s, "spark", "staging"))
+	require.Equal(t, 0.0, counterValue(s, "spark", "finished"))
+	require.Equal(t, 0.0, filteredItems(t, filters, filteredFramework))
+}
+
+func TestMasterSubscriberForgetsTasks(t *testing.T) {
+	events := []string{
+		`{
+			"type": "SUBSCRIBED",
+			"subscribed": {
+				"get_state": {
+					"get_tasks": {
+						"tasks": [
+							{"task_id": {"value": "task1"}, "framework_id": {"value": "fw1"}, "agent_id": {"value": "agent1"}, "state": "TASK_RUNNING"},
+							{"task_id": {"value": "task2"}, "framework_id": {"value": "fw2"}, "agent_id": {"value": "agent1"}, "state": "TASK_RUNNING"}
+						]
+					},
+					"get_frameworks": {
+						"frameworks": [
+							{"active": true, "framework_info": {"id": {"value": "fw1"}, "name": "marathon"}},
+							{"active": true, "framework_info": {"id": {"value": "fw2"}, "name": "chronos"}}
+						]
+					}
+				}
+			}
+		}`,
+		`{"type": "TASK_ADDED", "task_added": {"task": {"task_id": {"value": "task3"}, "framework_id": {"value": "fw1"}, "agent_id": {"value": "agent2"}, "state": "TASK_STAGING"}}}`,
+		`{"type": "TASK_UPDATED", "task_updated": {"framework_id": {"value": "fw1"}, "state": "TASK_RUNNING", "status": {"task_id": {"value": "task3"}}}}`,
+		`{"type": "FRAMEWORK_REMOVED", "framework_removed": {"framework_info": {"id": {"value": "fw2"}}}}`,
+		`{"type": "AGENT_REMOVED", "agent_removed": {"agent_id": {"value": "agent2"}}}`,
+	}
+
+	s := newMasterSubscriber(&http.Client{}, &Config{}, nil, NewFrameworkRegistry(0))
+
+	tasks := func() []string {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		keys := []string{}
+		for key := range s.tasks {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		return keys
+	}
+
+	expected := [][]string{
+		{"fw1/task1", "fw2/task2"},
+		{"fw1/task1", "fw1/task3", "fw2/task2"},
+		{"fw1/task1", "fw1/task3", "fw2/task2"},
+		{"fw1/task1", "fw1/task3"},
+		{"fw1/task1"},
+	}
+
+	for i, data := range events {
+		var event v1Event
+
+		require.NoError(t, json.Unmarshal([]byte(data), &event))
+
+		s.handle(event)
+
+		require.Equal(t, expected[i], tasks(), "after event %d", i)
+	}
+}
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	apiVersionAuto = "auto"
+	apiVersionV0   = "v0"
+	apiVersionV1   = "v1"
+
+	masterEndpointsSplit = "split"
+	masterEndpointsState = "state"
+
+	slaveUrlDirect = "direct"
+	slaveUrlMaster = "master"
+)
+
+// The first version of Mesos that supports GET_STATE on masters and GET_CONTAINERS on agents.
+var apiV1MinVersion = []int{1, 1}
+
+// Talks to Mesos masters and slaves either through the legacy endpoints
+// (/master/state.json, /monitor/statistics.json) or the v1 Operator API.
+// In auto mode the API is chosen by querying /version of each master or slave once.
+type mesosApi struct {
+	config   *Config
+	leader   *url.URL
+	metrics  *targetMetrics
+	mutex    *sync.Mutex
+	versions map[string]string
+}
+
+// Values available in the template of -mesos.slave-url.
+type slaveUrlData struct {
+	Address  string
+	Hostname string
+	ID       string
+	Pid      string
+}
+
+// Retrieves the state of the master at the given URL.
+func (a *mesosApi) masterState(c *http.Client, master *Master, url string) error {
+	return instrument(a.metrics, c, kindMaster, url, a.config.maxResponseSize(), func(c *http.Client) error {
+		version, err := a.version(c, url)
+		if err != nil {
+			return err
+		}
+
+		if version == apiVersionV0 && a.config.MesosMasterEndpoints == masterEndpointsSplit {
+			err = retrieveMasterStateSplit(c, master, url, a.config.MesosMasterTasksPageSize)
+		} else if version == apiVersionV0 {
+			err = retrieveMasterState(c, master, url)
+		} else {
+			err = retrieveMasterStateV1(c, master, url)
+		}
+
+		if err != nil {
+			a.forget(url)
+		}
+
+		return err
+	})
+}
+
+// Retrieves statistics of all tasks running on the slave.
+func (a *mesosApi) slaveStats(c *http.Client, stats *[]MonitoredTask, slave Slave) error {
+	return instrument(a.metrics, c, kindSlave, slave.Pid, a.config.maxResponseSize(), func(c *http.Client) error {
+		url, err := a.slaveUrl(slave)
+		if err != nil {
+			return err
+		}
+
+		version, err := a.version(c, url)
+		if err != nil {
+			return err
+		}
+
+		if version == apiVersionV0 {
+			err = retrieveStats(c, stats, url+"/monitor/statistics.json")
+		} else {
+			err = retrieveStatsV1(c, stats, url)
+		}
+
+		if err != nil {
+			a.forget(url)
+		}
+
+		return err
+	})
+}
+
+// Retrieves which tasks the executors on the slave run.
+func (a *mesosApi) slaveState(c *http.Client, state *slaveState, slave Slave) error {
+	return instrument(a.metrics, c, kindSlave, slave.Pid, a.config.maxResponseSize(), func(c *http.Client) error {
+		url, err := a.slaveUrl(slave)
+		if err != nil {
+			return err
+		}
+
+		version, err := a.version(c, url)
+		if err != nil {
+			return err
+		}
+
+		if version == apiVersionV0 {
+			err = retrieveSlaveState(c, state, url+"/state.json")
+		} else {
+			err = retrieveSlaveStateV1(c, state, url)
+		}
+
+		if err != nil {
+			a.forget(url)
+		}
+
+		return err
+	})
+}
+
+// Drops what is known about a slave that left the cluster.
+func (a *mesosApi) removeSlave(slave Slave) {
+	a.metrics.remove(kindSlave, slave.Pid)
+
+	if url, err := a.slaveUrl(slave); err == nil {
+		a.forget(url)
+	}
+}
+
+// Remembers the master leader to proxy requests to slaves through.
+func (a *mesosApi) setLeader(leader *url.URL) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.leader = leader
+}
+
+// URL under which the endpoints of a slave are reachable: the address of the slave
+// itself, the proxy of the master leader or a URL built from a template.
+func (a *mesosApi) slaveUrl(slave Slave) (string, error) {
+	if a.config.MesosSlaveUrlTemplate != nil {
+		var buf bytes.Buffer
+
+		// Templates that don't use the address work without a valid PID
+		address, _ := slave.address()
+
+		err := a.config.MesosSlaveUrlTemplate.Execute(&buf, slaveUrlData{
+			Address:  address,
+			Hostname: slave.Hostname,
+			ID:       slave.Id,
+			Pid:      slave.Pid,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		// Templates may point to the statistics endpoint itself
+		url := strings.TrimSuffix(buf.String(), "/monitor/statistics.json")
+		url = strings.TrimSuffix(url, "/monitor/statistics")
+
+		return strings.TrimSuffix(url, "/"), nil
+	}
+
+	if a.config.MesosSlaveUrl == slaveUrlMaster {
+		a.mutex.Lock()
+		leader := a.leader
+		a.mutex.Unlock()
+
+		if leader == nil {
+			return "", fmt.Errorf("No Mesos master leader known to proxy requests to slave '%s'", slave.Pid)
+		}
+
+		return fmt.Sprintf("%s/slave/%s", strings.TrimSuffix(leader.String(), "/"), slave.Id), nil
+	}
+
+	address, ok := slave.address()
+	if ok == false {
+		return "", fmt.Errorf("Unable to determine address of Mesos slave '%s' from its PID '%s'", slave.key(), slave.Pid)
+	}
+
+	return fmt.Sprintf("%s://%s", a.config.MesosSlaveScheme, address), nil
+}
+
+// Forgets the detected API version of a master or slave. The version is detected
+// again on the next request in case Mesos has been upgraded in the meantime.
+func (a *mesosApi) forget(url string) {
+	if a.config.MesosApiVersion != apiVersionAuto {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.versions, url)
+}
+
+func (a *mesosApi) version(c *http.Client, url string) (string, error) {
+	if a.config.MesosApiVersion != apiVersionAuto {
+		return a.config.MesosApiVersion, nil
+	}
+
+	a.mutex.Lock()
+	version, ok := a.versions[url]
+	a.mutex.Unlock()
+
+	if ok {
+		return version, nil
+	}
+
+	version, err := detectApiVersion(c, url)
+	if err != nil {
+		return "", err
+	}
+
+	log.Debugf("Using API %s to query '%s'", version, url)
+
+	a.mutex.Lock()
+	a.versions[url] = version
+	a.mutex.Unlock()
+
+	return version, nil
+}
+
+func newMesosApi(conf *Config) *mesosApi {
+	return &mesosApi{
+		config:   conf,
+		metrics:  newTargetMetrics(),
+		mutex:    &sync.Mutex{},
+		versions: make(map[string]string),
+	}
+}
+
+// Queries /version of a master or slave to decide which API to use.
+func detectApiVersion(c *http.Client, url string) (string, error) {
+	var v struct {
+		Version string
+	}
+
+	resp, err := c.Get(url + "/version")
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &statusError{resp.StatusCode, fmt.Sprintf("Unexpected status code %d from '%s/version'", resp.StatusCode, url)}
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		return "", err
+	}
+
+	if supportsApiV1(v.Version) {
+		return apiVersionV1, nil
+	}
+
+	return apiVersionV0, nil
+}
+
+func supportsApiV1(version string) bool {
+	parts := strings.Split(version, ".")
+
+	for i, min := range apiV1MinVersion {
+		if i >= len(parts) {
+			return false
+		}
+
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return false
+		}
+
+		if n != min {
+			return n > min
+		}
+	}
+
+	return true
+}
+
+type v1Value struct {
+	Value string
+}
+
+type v1Scalar struct {
+	Value float64
+}
+
+type v1Ranges struct {
+	Range []struct {
+		Begin int
+		End   int
+	}
+}
+
+type v1Set struct {
+	Item []string
+}
+
+type v1Resource struct {
+	Name   string
+	Ranges *v1Ranges
+	Scalar *v1Scalar
+	Set    *v1Set
+	Type   string
+}
+
+type v1Attribute struct {
+	Name   string
+	Ranges *v1Ranges
+	Scalar *v1Scalar
+	Set    *v1Set
+	Text   *v1Value
+	Type   string
+}
+
+type v1Label struct {
+	Key   string
+	Value string
+}
+
+type v1Task struct {
+	AgentId     v1Value `json:"agent_id"`
+	Discovery   *Discovery
+	FrameworkId v1Value `json:"framework_id"`
+	Labels      struct {
+		Labels []v1Label
+	}
+	ExecutorId *v1Value `json:"executor_id"`
+	Name       string
+	Resources  []v1Resource
+	State      string
+	Statuses   []v1TaskStatus
+	TaskId     v1Value `json:"task_id"`
+}
+
+type v1ContainerId struct {
+	Parent *v1ContainerId
+	Value  string
+}
+
+type v1TaskStatus struct {
+	ContainerStatus struct {
+		ContainerId *v1ContainerId `json:"container_id"`
+	} `json:"container_status"`
+}
+
+type v1Framework struct {
+	Active             bool
+	AllocatedResources []v1Resource `json:"allocated_resources"`
+	FrameworkInfo      struct {
+		Id    v1Value
+		Name  string
+		Role  string
+		Roles []string
+	} `json:"framework_info"`
+}
+
+type v1Agent struct {
+	Active    bool
+	AgentInfo struct {
+		Attributes []v1Attribute
+		Hostname   string
+		Id         v1Value
+	} `json:"agent_info"`
+	Pid            string
+	TotalResources []v1Resource `json:"total_resources"`
+}
+
+type v1State struct {
+	GetAgents struct {
+		Agents []v1Agent
+	} `json:"get_agents"`
+	GetFrameworks struct {
+		Frameworks []v1Framework
+	} `json:"get_frameworks"`
+	GetTasks struct {
+		Tasks []v1Task
+	} `json:"get_tasks"`
+}
+
+// Frameworks with the tasks that belong to them in the format of the legacy endpoints.
+func (st *v1State) frameworks() []Framework {
+	tasks := make(map[string][]Task)
+	for _, t := range st.GetTasks.Tasks {
+		tasks[t.FrameworkId.Value] = append(tasks[t.FrameworkId.Value], convertTaskV1(t))
+	}
+
+	frameworks := []Framework{}
+	for _, f := range st.GetFrameworks.Frameworks {
+		framework := convertFrameworkV1(f)
+		framework.Tasks = tasks[framework.Id]
+
+		frameworks = append(frameworks, framework)
+	}
+
+	return frameworks
+}
+
+func (st *v1State) slaves() []Slave {
+	slaves := []Slave{}
+	for _, a := range st.GetAgents.Agents {
+		slaves = append(slaves, convertAgentV1(a))
+	}
+
+	return slaves
+}
+
+type v1MasterResponse struct {
+	GetMaster struct {
+		MasterInfo MasterInfo `json:"master_info"`
+	} `json:"get_master"`
+	GetMetrics struct {
+		Metrics []struct {
+			Name  string
+			Value float64
+		}
+	} `json:"get_metrics"`
+	GetState v1State `json:"get_state"`
+}
+
+type v1AgentResponse struct {
+	GetContainers struct {
+		Containers []struct {
+			ContainerId        v1ContainerId `json:"container_id"`
+			ExecutorId         v1Value       `json:"executor_id"`
+			FrameworkId        v1Value       `json:"framework_id"`
+			ResourceStatistics *Statistics   `json:"resource_statistics"`
+		}
+	} `json:"get_containers"`
+	GetState struct {
+		GetTasks struct {
+			LaunchedTasks []v1Task `json:"launched_tasks"`
+		} `json:"get_tasks"`
+	} `json:"get_state"`
+}
+
+// Sends a call to the v1 Operator API at url and decodes the response into res.
+func callApiV1(c *http.Client, url string, call string, res interface{}) error {
+	return callApiV1WithOptions(c, url, call, nil, res)
+}
+
+// Sends a call with options, e.g. {"show_nested": true} for GET_CONTAINERS.
+func callApiV1WithOptions(c *http.Client, url string, call string, options map[string]interface{}, res interface{}) error {
+	message := map[string]interface{}{"type": call}
+	if options != nil {
+		message[strings.ToLower(call)] = options
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url+"/api/v1", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{resp.StatusCode, fmt.Sprintf("Call %s to '%s' failed with status code %d: %s", call, url, resp.StatusCode, strings.TrimSpace(string(data)))}
+	}
+
+	return json.Unmarshal(data, res)
+}
+
+// Retrieves the state of a master through the v1 Operator API. Requests to a master
+// that is not the leader are redirected to the leader by Mesos.
+func retrieveMasterStateV1(c *http.Client, master *Master, url string) error {
+	var masterRes, metricsRes, stateRes v1MasterResponse
+
+	err := callApiV1(c, url, "GET_MASTER", &masterRes)
+	if err != nil {
+		return err
+	}
+
+	err = callApiV1(c, url, "GET_METRICS", &metricsRes)
+	if err != nil {
+		return err
+	}
+
+	err = callApiV1(c, url, "GET_STATE", &stateRes)
+	if err != nil {
+		return err
+	}
+
+	info := masterRes.GetMaster.MasterInfo
+	address, err := info.address()
+	if err != nil {
+		return err
+	}
+
+	master.Leader = "master@" + address
+	master.LeaderInfo = info
+	master.Version = info.Version
+
+	for _, metric := range metricsRes.GetMetrics.Metrics {
+		value := metric.Value
+
+		switch metric.Name {
+		case "master/tasks_failed":
+			master.FailedTasks = &value
+		case "master/tasks_finished":
+			master.FinishedTasks = &value
+		case "master/tasks_killed":
+			master.KilledTasks = &value
+		case "master/tasks_lost":
+			master.LostTasks = &value
+		}
+	}
+
+	master.Frameworks = stateRes.GetState.frameworks()
+	master.Slaves = stateRes.GetState.slaves()
+
+	return nil
+}
+
+// Retrieves statistics of all containers on a slave through the v1 Operator API,
+// including the containers that tasks of a task group run in. Slaves before Mesos
+// 1.6 only report the container of the executor.
+func retrieveStatsV1(c *http.Client, stats *[]MonitoredTask, url string) error {
+	var res v1AgentResponse
+
+	err := callApiV1WithOptions(c, url, "GET_CONTAINERS", map[string]interface{}{"show_nested": true}, &res)
+	if err != nil {
+		return err
+	}
+
+	*stats = []MonitoredTask{}
+	for _, container := range res.GetContainers.Containers {
+		if container.ResourceStatistics == nil {
+			continue
+		}
+
+		*stats = append(*stats, MonitoredTask{
+			ContainerId: container.ContainerId.Value,
+			ExecutorId:  container.ExecutorId.Value,
+			FrameworkId: container.FrameworkId.Value,
+			Nested:      container.ContainerId.Parent != nil,
+			Statistics:  *container.ResourceStatistics,
+		})
+	}
+
+	return nil
+}
+
+// Retrieves which tasks the executors on a slave run through the v1 Operator API.
+func retrieveSlaveStateV1(c *http.Client, state *slaveState, url string) error {
+	var res v1AgentResponse
+
+	err := callApiV1(c, url, "GET_STATE", &res)
+	if err != nil {
+		return err
+	}
+
+	for _, task := range res.GetState.GetTasks.LaunchedTasks {
+		executorId := task.TaskId.Value
+		if task.ExecutorId != nil && task.ExecutorId.Value != "" {
+			executorId = task.ExecutorId.Value
+		}
+
+		containerIds := []string{}
+		for _, status := range task.Statuses {
+			if status.ContainerStatus.ContainerId != nil {
+				containerIds = append(containerIds, status.ContainerStatus.ContainerId.Value)
+			}
+		}
+
+		state.add(task.FrameworkId.Value, executorId, task.TaskId.Value, containerIds)
+	}
+
+	return nil
+}
+
+func convertTaskV1(t v1Task) Task {
+	task := Task{
+		Discovery: t.Discovery,
+		Id:        t.TaskId.Value,
+		Name:      t.Name,
+		Resources: convertResourcesV1(t.Resources),
+		SlaveId:   t.AgentId.Value,
+		State:     t.State,
+	}
+
+	if t.ExecutorId != nil {
+		task.ExecutorId = t.ExecutorId.Value
+	}
+
+	for _, label := range t.Labels.Labels {
+		task.Labels = append(task.Labels, Label{Key: label.Key, Value: label.Value})
+	}
+
+	return task
+}
+
+// Converts a framework without its tasks.
+func convertFrameworkV1(f v1Framework) Framework {
+	return Framework{
+		Active:        f.Active,
+		Id:            f.FrameworkInfo.Id.Value,
+		Name:          f.FrameworkInfo.Name,
+		Role:          f.FrameworkInfo.Role,
+		Roles:         f.FrameworkInfo.Roles,
+		UsedResources: convertResourcesV1(f.AllocatedResources),
+	}
+}
+
+func convertAgentV1(a v1Agent) Slave {
+	slave := Slave{
+		Active:     a.Active,
+		Attributes: make(map[string]interface{}),
+		Hostname:   a.AgentInfo.Hostname,
+		Id:         a.AgentInfo.Id.Value,
+		Pid:        a.Pid,
+		Resources:  convertResourcesV1(a.TotalResources),
+	}
+
+	for _, attribute := range a.AgentInfo.Attributes {
+		slave.Attributes[attribute.Name] = convertAttributeV1(attribute)
+	}
+
+	return slave
+}
+
+func formatRangesV1(r *v1Ranges) string {
+	ranges := []string{}
+	for _, item := range r.Range {
+		ranges = append(ranges, fmt.Sprintf("%d-%d", item.Begin, item.End))
+	}
+
+	return "[" + strings.Join(ranges, ", ") + "]"
+}
+
+// Converts resources to the format of the legacy endpoints. Resources of the same
+// name, e.g. reserved for different roles, are added up.
+func convertResourcesV1(resources []v1Resource) Resources {
+	var converted Resources
+
+	ports := []string{}
+
+	for _, resource := range resources {
+		if resource.Scalar != nil {
+			switch resource.Name {
+			case "cpus":
+				converted.Cpus = converted.Cpus + resource.Scalar.Value
+			case "disk":
+				converted.Disk = converted.Disk + resource.Scalar.Value
+			case "gpus":
+				converted.Gpus = converted.Gpus + resource.Scalar.Value
+			case "mem":
+				converted.Mem = converted.Mem + resource.Scalar.Value
+			}
+		}
+
+		if resource.Name == "ports" && resource.Ranges != nil && len(resource.Ranges.Range) > 0 {
+			ports = append(ports, strings.Trim(formatRangesV1(resource.Ranges), "[]"))
+		}
+	}
+
+	if len(ports) > 0 {
+		converted.Ports = "[" + strings.Join(ports, ", ") + "]"
+	}
+
+	return converted
+}
+
+// Converts an attribute to the value it has in the legacy endpoints.
+func convertAttributeV1(attribute v1Attribute) interface{} {
+	switch {
+	case attribute.Text != nil:
+		return attribute.Text.Value
+	case attribute.Scalar != nil:
+		return attribute.Scalar.Value
+	case attribute.Ranges != nil:
+		return formatRangesV1(attribute.Ranges)
+	case attribute.Set != nil:
+		items := append([]string{}, attribute.Set.Item...)
+		sort.Strings(items)
+		return "{" + strings.Join(items, ",") + "}"
+	}
+
+	return ""
+}
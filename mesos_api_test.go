@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Responses of a master running Mesos 1.4 to calls of the v1 Operator API.
+var fakeMasterV1Responses = map[string]string{
+	"GET_MASTER": `{
+		"type": "GET_MASTER",
+		"get_master": {
+			"master_info": {
+				"id": "master1",
+				"pid": "master@10.0.0.1:5050",
+				"address": {"hostname": "master1", "ip": "10.0.0.1", "port": 5050}
+			}
+		}
+	}`,
+	"GET_METRICS": `{
+		"type": "GET_METRICS",
+		"get_metrics": {
+			"metrics": [
+				{"name": "master/tasks_failed", "value": 1},
+				{"name": "master/tasks_finished", "value": 2},
+				{"name": "master/tasks_killed", "value": 3},
+				{"name": "master/tasks_lost", "value": 4},
+				{"name": "master/tasks_staging", "value": 5},
+				{"name": "master/uptime_secs", "value": 100}
+			]
+		}
+	}`,
+	"GET_STATE": `{
+		"type": "GET_STATE",
+		"get_state": {
+			"get_tasks": {
+				"tasks": [{
+					"name": "redis",
+					"task_id": {"value": "task1"},
+					"framework_id": {"value": "fw1"},
+					"agent_id": {"value": "agent1"},
+					"state": "TASK_RUNNING",
+					"discovery": {"name": "redis", "ports": {"ports": [{"number": 31000, "name": "redis", "protocol": "tcp"}]}},
+					"labels": {"labels": [{"key": "team", "value": "cache"}]},
+					"resources": [
+						{"name": "cpus", "type": "SCALAR", "scalar": {"value": 0.5}},
+						{"name": "mem", "type": "SCALAR", "scalar": {"value": 128}},
+						{"name": "ports", "type": "RANGES", "ranges": {"range": [{"begin": 31000, "end": 31001}]}}
+					]
+				}]
+			},
+			"get_frameworks": {
+				"frameworks": [{
+					"active": true,
+					"framework_info": {"id": {"value": "fw1"}, "name": "marathon"},
+					"allocated_resources": [
+						{"name": "cpus", "type": "SCALAR", "scalar": {"value": 0.5}, "role": "a"},
+						{"name": "cpus", "type": "SCALAR", "scalar": {"value": 1}, "role": "b"}
+					]
+				}]
+			},
+			"get_agents": {
+				"agents": [{
+					"pid": "slave(1)@10.0.0.2:5051",
+					"agent_info": {
+						"id": {"value": "agent1"},
+						"hostname": "agent1",
+						"attributes": [
+							{"name": "rack", "type": "TEXT", "text": {"value": "r1"}},
+							{"name": "level", "type": "SCALAR", "scalar": {"value": 2}},
+							{"name": "zones", "type": "SET", "set": {"item": ["b", "a"]}}
+						]
+					},
+					"total_resources": [
+						{"name": "disk", "type": "SCALAR", "scalar": {"value": 1024}},
+						{"name": "ports", "type": "RANGES", "ranges": {"range": [{"begin": 31000, "end": 32000}]}},
+						{"name": "ports", "type": "RANGES", "ranges": {"range": [{"begin": 33000, "end": 33000}]}}
+					]
+				}]
+			}
+		}
+	}`,
+}
+
+var fakeAgentV1Responses = map[string]string{
+	"GET_CONTAINERS": `{
+		"type": "GET_CONTAINERS",
+		"get_containers": {
+			"containers": [
+				{
+					"framework_id": {"value": "fw1"},
+					"executor_id": {"value": "task1"},
+					"container_id": {"value": "c1"},
+					"resource_statistics": {"timestamp": 1, "cpus_limit": 1.5, "mem_rss_bytes": 1024, "cpus_nr_throttled": 3}
+				},
+				{
+					"framework_id": {"value": "fw1"},
+					"executor_id": {"value": "task2"},
+					"container_id": {"value": "c2"}
+				},
+				{
+					"framework_id": {"value": "fw1"},
+					"executor_id": {"value": "default"},
+					"container_id": {"value": "c4", "parent": {"value": "c3"}},
+					"resource_statistics": {"timestamp": 1, "cpus_limit": 0.5}
+				}
+			]
+		}
+	}`,
+}
+
+// Serves /version and calls of the v1 Operator API from the given responses.
+// Legacy endpoints are answered with the given body and counted in legacyCount.
+func newFakeMesosServer(t *testing.T, version string, responses map[string]string, legacy string, legacyCount *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/version":
+			w.Write([]byte(`{"version": "` + version + `"}`))
+		case "/api/v1":
+			var call struct {
+				Type string
+			}
+
+			data, _ := ioutil.ReadAll(r.Body)
+			require.NoError(t, json.Unmarshal(data, &call))
+			require.Equal(t, "POST", r.Method)
+
+			res, ok := responses[call.Type]
+			if ok == false {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Unsupported call"))
+				return
+			}
+
+			w.Write([]byte(res))
+		default:
+			*legacyCount = *legacyCount + 1
+			w.Write([]byte(legacy))
+		}
+	}))
+}
+
+func TestSupportsApiV1(t *testing.T) {
+	for version, expected := range map[string]bool{
+		"0.28.2":  false,
+		"1.0.1":   false,
+		"1.1.0":   true,
+		"1.4.0":   true,
+		"2.0.0":   true,
+		"1":       false,
+		"invalid": false,
+	} {
+		require.Equal(t, expected, supportsApiV1(version), version)
+	}
+}
+
+func TestRetrieveMasterStateV1(t *testing.T) {
+	legacyCount := 0
+
+	ts := newFakeMesosServer(t, "1.4.0", fakeMasterV1Responses, "", &legacyCount)
+	defer ts.Close()
+
+	var master Master
+	require.NoError(t, newMesosApi(&Config{MesosApiVersion: apiVersionV1, MesosSlaveScheme: "http"}).masterState(&http.Client{}, &master, ts.URL))
+
+	require.Equal(t, "master@10.0.0.1:5050", master.Leader)
+
+	require.Equal(t, 1.0, *master.FailedTasks)
+	require.Equal(t, 2.0, *master.FinishedTasks)
+	require.Equal(t, 3.0, *master.KilledTasks)
+	require.Equal(t, 4.0, *master.LostTasks)
+	// Gauges of the tasks staging right now are not mixed into the counters
+	require.Nil(t, master.StagedTasks)
+	require.Nil(t, master.StartedTasks)
+
+	require.Len(t, master.Frameworks, 1)
+	require.Equal(t, "marathon", master.Frameworks[0].Name)
+	require.Equal(t, 1.5, master.Frameworks[0].UsedResources.Cpus)
+
+	discovery := &Discovery{Name: "redis"}
+	discovery.Ports.Ports = []DiscoveryPort{{Name: "redis", Number: 31000, Protocol: "tcp"}}
+
+	require.Equal(t, []Task{{
+		Discovery: discovery,
+		Id:        "task1",
+		Labels:    []Label{{Key: "team", Value: "cache"}},
+		Name:      "redis",
+		Resources: Resources{Cpus: 0.5, Mem: 128, Ports: "[31000-31001]"},
+		SlaveId:   "agent1",
+		State:     "TASK_RUNNING",
+	}}, master.Frameworks[0].Tasks)
+
+	require.Len(t, master.Slaves, 1)
+	require.Equal(t, "slave(1)@10.0.0.2:5051", master.Slaves[0].Pid)
+	require.Equal(t, "agent1", master.Slaves[0].Hostname)
+	require.Equal(t, Resources{Disk: 1024, Ports: "[31000-32000, 33000-33000]"}, master.Slaves[0].Resources)
+	require.Equal(t, map[string]interface{}{"level": 2.0, "rack": "r1", "zones": "{a,b}"}, master.Slaves[0].Attributes)
+
+	require.Equal(t, 0, legacyCount)
+}
+
+func TestRetrieveStatsV1(t *testing.T) {
+	legacyCount := 0
+
+	ts := newFakeMesosServer(t, "1.4.0", fakeAgentV1Responses, "", &legacyCount)
+	defer ts.Close()
+
+	slaveUrl, _ := url.Parse(ts.URL)
+
+	var stats []MonitoredTask
+	require.NoError(t, newMesosApi(&Config{MesosApiVersion: apiVersionV1, MesosSlaveScheme: "http"}).slaveStats(&http.Client{}, &stats, Slave{Pid: "slave(1)@" + slaveUrl.Host}))
+
+	// Containers without statistics are skipped
+	require.Len(t, stats, 2)
+	require.Equal(t, "task1", stats[0].ExecutorId)
+	require.Equal(t, "c1", stats[0].ContainerId)
+	require.False(t, stats[0].Nested)
+	require.Equal(t, "fw1", stats[0].FrameworkId)
+	require.Equal(t, 1.5, stats[0].Statistics.CpusLimit)
+	require.Equal(t, 3.0, *stats[0].Statistics.CpusNrThrottled)
+	require.Nil(t, stats[0].Statistics.CpusThrottledTimeSecs)
+
+	// Containers of tasks in a task group are nested in the container of the executor
+	require.Equal(t, "default/c4", stats[1].key())
+	require.True(t, stats[1].Nested)
+}
+
+func TestMesosApiDetectsVersion(t *testing.T) {
+	legacyCount := 0
+
+	v0 := newFakeMesosServer(t, "0.28.2", nil, `{"leader": "master@10.0.0.3:5050"}`, &legacyCount)
+	defer v0.Close()
+
+	v1 := newFakeMesosServer(t, "1.4.0", fakeMasterV1Responses, "", &legacyCount)
+	defer v1.Close()
+
+	api := newMesosApi(&Config{MesosApiVersion: apiVersionAuto, MesosSlaveScheme: "http"})
+
+	var master Master
+	require.NoError(t, api.masterState(&http.Client{}, &master, v0.URL))
+	require.Equal(t, "master@10.0.0.3:5050", master.Leader)
+	require.Equal(t, 1, legacyCount)
+
+	master = Master{}
+	require.NoError(t, api.masterState(&http.Client{}, &master, v1.URL))
+	require.Equal(t, "master@10.0.0.1:5050", master.Leader)
+	require.Equal(t, 1, legacyCount)
+
+	require.Equal(t, map[string]string{v0.URL: apiVersionV0, v1.URL: apiVersionV1}, api.versions)
+}
+
+func TestParseSlaveUrl(t *testing.T) {
+	for _, value := range []string{slaveUrlDirect, slaveUrlMaster} {
+		tmpl, err := parseSlaveUrl(value)
+		require.NoError(t, err)
+		require.Nil(t, tmpl)
+	}
+
+	tmpl, err := parseSlaveUrl("https://router/agent/{{.ID}}")
+	require.NoError(t, err)
+	require.NotNil(t, tmpl)
+
+	_, err = parseSlaveUrl("proxy")
+	require.Error(t, err)
+
+	_, err = parseSlaveUrl("https://router/agent/{{.ID")
+	require.Error(t, err)
+}
+
+func TestSlaveUrl(t *testing.T) {
+	slave := Slave{Hostname: "slave1", Id: "s1", Pid: "slave(1)@10.0.0.1:5051"}
+
+	direct := newMesosApi(&Config{MesosSlaveScheme: "https", MesosSlaveUrl: slaveUrlDirect})
+
+	u, err := direct.slaveUrl(slave)
+	require.NoError(t, err)
+	require.Equal(t, "https://10.0.0.1:5051", u)
+
+	proxied := newMesosApi(&Config{MesosSlaveScheme: "http", MesosSlaveUrl: slaveUrlMaster})
+
+	// Slaves can't be reached before the leader is known
+	_, err = proxied.slaveUrl(slave)
+	require.Error(t, err)
+
+	leader, _ := url.Parse("https://master1:5050")
+	proxied.setLeader(leader)
+
+	u, err = proxied.slaveUrl(slave)
+	require.NoError(t, err)
+	require.Equal(t, "https://master1:5050/slave/s1", u)
+
+	for _, value := range []string{"https://router/agent/{{.ID}}", "https://router/agent/{{.ID}}/monitor/statistics", "https://router/agent/{{.ID}}/"} {
+		tmpl, err := parseSlaveUrl(value)
+		require.NoError(t, err)
+
+		u, err = newMesosApi(&Config{MesosSlaveUrl: value, MesosSlaveUrlTemplate: tmpl}).slaveUrl(slave)
+		require.NoError(t, err)
+		require.Equal(t, "https://router/agent/s1", u, value)
+	}
+
+	tmpl, err := parseSlaveUrl("http://{{.Hostname}}:5051/{{.Pid}}/{{.Address}}")
+	require.NoError(t, err)
+
+	u, err = newMesosApi(&Config{MesosSlaveUrlTemplate: tmpl}).slaveUrl(slave)
+	require.NoError(t, err)
+	require.Equal(t, "http://slave1:5051/slave(1)@10.0.0.1:5051/10.0.0.1:5051", u)
+
+	// Slaves without an address in their PID can only be reached through a proxy
+	for _, pid := range []string{"", "slave(1)", "slave(1)@"} {
+		invalid := Slave{Hostname: "slave1", Id: "s1", Pid: pid}
+
+		_, err = direct.slaveUrl(invalid)
+		require.Error(t, err, pid)
+
+		u, err = proxied.slaveUrl(invalid)
+		require.NoError(t, err, pid)
+		require.Equal(t, "https://master1:5050/slave/s1", u)
+
+		// The address is left empty in templates
+		u, err = newMesosApi(&Config{MesosSlaveUrlTemplate: tmpl}).slaveUrl(invalid)
+		require.NoError(t, err, pid)
+		require.Equal(t, "http://slave1:5051/"+pid, u)
+	}
+}
+
+func TestSlaveStatsThroughMaster(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slave/s1/monitor/statistics.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Write([]byte(`[{"executor_id": "task1", "framework_id": "fw1", "statistics": {"cpus_limit": 1}}]`))
+	}))
+	defer ts.Close()
+
+	masterUrl, _ := url.Parse(ts.URL)
+
+	api := newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http", MesosSlaveUrl: slaveUrlMaster})
+	api.setLeader(masterUrl)
+
+	var stats []MonitoredTask
+	require.NoError(t, api.slaveStats(&http.Client{}, &stats, Slave{Id: "s1", Pid: "slave(1)@10.0.0.1:5051"}))
+	require.Len(t, stats, 1)
+	require.Equal(t, "task1", stats[0].ExecutorId)
+}
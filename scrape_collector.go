@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type slaveStats struct {
+	err   error
+	slave Slave
+	tasks []MonitoredTask
+}
+
+// Queries the Mesos master and all slaves every time metrics are requested
+// instead of polling them in the background. Frameworks and slaves that have been
+// filtered and tasks that have been skipped are remembered while Mesos reports
+// them, so that they are only matched and counted once.
+type scrapeCollector struct {
+	// Tasks over the limit by the key of their slave, kept between scrapes
+	aggregates         map[string]*taskAggregates
+	api                *mesosApi
+	config             *Config
+	discovery          *serviceDiscovery
+	filteredFrameworks map[string]struct{}
+	filteredSlaves     map[string]struct{}
+	frameworkResources *prometheus.Desc
+	httpClient         *http.Client
+	leaderMetrics      *leaderMetrics
+	limiter            *taskLimiter
+	masterPoller       *masterPoller
+	mutex              *sync.Mutex
+	previous           map[string]*Statistics
+	slaveResources     *prometheus.Desc
+	skippedTasks       map[string]map[string]struct{}
+	slaves             map[string]Slave
+	taskStatistics     []*prometheus.Desc
+	tasks              *prometheus.Desc
+}
+
+func (c *scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.frameworkResources
+	ch <- c.slaveResources
+	ch <- c.tasks
+
+	c.leaderMetrics.Describe(ch)
+
+	for _, desc := range c.taskStatistics {
+		ch <- desc
+	}
+}
+
+func (c *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	deadline := time.Now().Add(c.config.ExporterScrapeTimeout)
+
+	// The masters and the slaves share the deadline of the scrape. Requests still in
+	// progress are cancelled once the scrape is done.
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// The master poller remembers the current leader and is not safe for concurrent use
+	c.mutex.Lock()
+	master, err := c.masterPoller.retrieveCurrentMasterState(ctx)
+	c.mutex.Unlock()
+
+	c.leaderMetrics.update(master, err)
+	c.leaderMetrics.Collect(ch)
+
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if c.discovery != nil {
+		c.discovery.update(master)
+	}
+
+	// Slaves that are filtered are not queried at all
+	slaves := []Slave{}
+	filteredSlaves := make(map[string]struct{})
+
+	c.mutex.Lock()
+	for _, slave := range uniqueSlaves(master.Slaves) {
+		if _, ok := c.filteredSlaves[slave.key()]; ok || c.config.Filters.keepSlave(slave) == false {
+			filteredSlaves[slave.key()] = struct{}{}
+			continue
+		}
+
+		slaves = append(slaves, slave)
+	}
+
+	c.filteredSlaves = filteredSlaves
+	c.mutex.Unlock()
+
+	master.Slaves = slaves
+
+	c.collectMaster(ch, master)
+	c.removeSlaves(master.Slaves)
+
+	remaining := deadline.Sub(time.Now())
+	if remaining <= 0 {
+		log.Errorf("Scrape deadline of %s exceeded while querying the Mesos master", c.config.ExporterScrapeTimeout)
+		return
+	}
+
+	frameworks := NewFrameworkRegistry(0)
+	frameworks.Replace(master.Frameworks)
+
+	requestTimeout, _ := c.config.slaveTimeouts()
+	client := newDeadlineClient(ctx, c.httpClient, requestTimeout)
+
+	// Statistics of this scrape, used to calculate rates during the next scrape
+	current := make(map[string]*Statistics)
+	defer func() {
+		c.mutex.Lock()
+		c.previous = current
+		c.mutex.Unlock()
+	}()
+
+	queued := make(chan Slave, len(master.Slaves))
+	for _, slave := range master.Slaves {
+		queued <- slave
+	}
+	close(queued)
+
+	results := make(chan slaveStats, len(master.Slaves))
+
+	// At most MesosSlaveConcurrency slaves are queried at the same time
+	for i := 0; i < c.config.MesosSlaveConcurrency && i < len(master.Slaves); i++ {
+		go func() {
+			for slave := range queued {
+				var tasks []MonitoredTask
+
+				err := c.api.slaveStats(client, &tasks, slave)
+
+				results <- slaveStats{err: err, slave: slave, tasks: tasks}
+			}
+		}()
+	}
+
+	timeout := time.After(remaining)
+
+	for i := 0; i < len(master.Slaves); i++ {
+		select {
+		case result := <-results:
+			if result.err != nil {
+				log.Errorf("Error retrieving stats from slave '%s': %s", result.slave.Pid, result.err)
+				continue
+			}
+
+			c.collectSlave(ch, client, result.slave, result.tasks, frameworks, current)
+		case <-timeout:
+			log.Errorf("Scrape deadline of %s exceeded - %d of %d slaves did not respond in time", c.config.ExporterScrapeTimeout, len(master.Slaves)-i, len(master.Slaves))
+			return
+		}
+	}
+}
+
+func (c *scrapeCollector) collectMaster(ch chan<- prometheus.Metric, master Master) {
+	for status, value := range master.taskCounters() {
+		if value != nil {
+			ch <- prometheus.MustNewConstMetric(c.tasks, prometheus.CounterValue, *value, status)
+		}
+	}
+
+	frameworks := []Framework{}
+	filteredFrameworks := make(map[string]struct{})
+
+	c.mutex.Lock()
+	for _, framework := range master.Frameworks {
+		if _, ok := c.filteredFrameworks[framework.Id]; ok || c.config.Filters.keepFramework(framework) == false {
+			filteredFrameworks[framework.Id] = struct{}{}
+			continue
+		}
+
+		frameworks = append(frameworks, framework)
+	}
+
+	c.filteredFrameworks = filteredFrameworks
+	c.mutex.Unlock()
+
+	for _, framework := range frameworks {
+		ch <- prometheus.MustNewConstMetric(c.frameworkResources, prometheus.GaugeValue, framework.UsedResources.Cpus, framework.Name, "cpus", "used")
+		ch <- prometheus.MustNewConstMetric(c.frameworkResources, prometheus.GaugeValue, framework.UsedResources.Disk, framework.Name, "disk", "used")
+		ch <- prometheus.MustNewConstMetric(c.frameworkResources, prometheus.GaugeValue, framework.UsedResources.Mem, framework.Name, "mem", "used")
+	}
+
+	for _, slave := range master.Slaves {
+		ch <- prometheus.MustNewConstMetric(c.slaveResources, prometheus.GaugeValue, slave.Resources.Cpus, slaveResourcesLabelValues(c.config, slave, "cpus")...)
+		ch <- prometheus.MustNewConstMetric(c.slaveResources, prometheus.GaugeValue, slave.Resources.Disk, slaveResourcesLabelValues(c.config, slave, "disk")...)
+		ch <- prometheus.MustNewConstMetric(c.slaveResources, prometheus.GaugeValue, slave.Resources.Mem, slaveResourcesLabelValues(c.config, slave, "mem")...)
+	}
+}
+
+// Returns the statistics of the task that have been collected during the previous
+// scrape and remembers the current ones for the next scrape.
+func (c *scrapeCollector) previousStatistics(current map[string]*Statistics, slave Slave, item MonitoredTask) *Statistics {
+	key := slave.key() + "/" + item.key()
+
+	statistics := item.Statistics
+	current[key] = &statistics
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.previous[key]
+}
+
+func (c *scrapeCollector) collectSlave(ch chan<- prometheus.Metric, client *http.Client, slave Slave, tasks []MonitoredTask, frameworks *frameworkRegistry, current map[string]*Statistics) {
+	aggregated := []aggregatedTask{}
+	available := make(map[string]struct{})
+	skipped := make(map[string]struct{})
+
+	// The tasks skipped by the previous scrape are replaced, never modified
+	c.mutex.Lock()
+	previouslySkipped := c.skippedTasks[slave.key()]
+	c.mutex.Unlock()
+
+	resolver := newTaskResolver(client, c.api, frameworks, slave)
+
+	for _, item := range withoutParentContainers(tasks) {
+		if _, ok := previouslySkipped[item.key()]; ok {
+			skipped[item.key()] = struct{}{}
+			continue
+		}
+
+		framework, task, ok := resolver.resolve(item)
+		if ok == false {
+			log.Debugf("Task of executor '%s' of framework '%s' not registered - not scraping", item.ExecutorId, item.FrameworkId)
+
+			if resolver.unknown(item) {
+				skipped[item.key()] = struct{}{}
+			}
+
+			continue
+		}
+
+		if c.config.Filters.keepTask(item.ExecutorId, framework, task) == false {
+			skipped[item.key()] = struct{}{}
+			continue
+		}
+
+		available[item.key()] = struct{}{}
+
+		sample := taskSample{
+			previous:   c.previousStatistics(current, slave, item),
+			resources:  task.Resources,
+			statistics: item.Statistics,
+		}
+
+		labelValues := append(taskLabelValues(c.config, item.ExecutorId, framework, task), slaveLabelValues(c.config, slave)...)
+
+		switch c.limiter.admit(slave, item.key(), framework.Name) {
+		case taskAggregated:
+			aggregated = append(aggregated, aggregatedTask{item.key(), labelValues, sample})
+			continue
+		case taskDropped:
+			continue
+		}
+
+		for i, statistic := range taskStatistics {
+			value, ok := statistic.value(sample)
+			if ok == false {
+				continue
+			}
+
+			ch <- prometheus.MustNewConstMetric(c.taskStatistics[i], statistic.valueType, value, labelValues...)
+		}
+	}
+
+	c.limiter.retain(slave, available)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.skippedTasks[slave.key()] = skipped
+
+	aggregates, ok := c.aggregates[slave.key()]
+	if ok == false {
+		aggregates = newTaskAggregates(c.config)
+		c.aggregates[slave.key()] = aggregates
+	}
+
+	aggregates.update(aggregated)
+
+	for _, aggregate := range aggregates.series {
+		for i, value := range aggregate.values {
+			if value != nil {
+				ch <- prometheus.MustNewConstMetric(c.taskStatistics[i], taskStatistics[i].valueType, *value, aggregate.labelValues...)
+			}
+		}
+	}
+}
+
+// Forgets slaves that have left the cluster or moved to another PID since the
+// previous scrape.
+func (c *scrapeCollector) removeSlaves(available []Slave) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	slaves := make(map[string]Slave)
+	for _, slave := range available {
+		slaves[slave.key()] = slave
+	}
+
+	for key, slave := range c.slaves {
+		current, ok := slaves[key]
+		if ok == false {
+			c.api.removeSlave(slave)
+			c.limiter.releaseSlave(slave)
+			delete(c.aggregates, key)
+			delete(c.skippedTasks, key)
+			continue
+		}
+
+		// A slave that moved to another PID keeps its tasks
+		if current.Pid != slave.Pid {
+			c.api.removeSlave(slave)
+		}
+	}
+
+	c.slaves = slaves
+}
+
+func newScrapeCollector(c *http.Client, api *mesosApi, conf *Config, detector *zkMasterDetector, discovery *serviceDiscovery, limiter *taskLimiter) *scrapeCollector {
+	taskStatisticDescs := make([]*prometheus.Desc, len(taskStatistics))
+	for i, statistic := range taskStatistics {
+		taskStatisticDescs[i] = prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, statistic.name),
+			statistic.help,
+			append(taskLabelNames(conf), slaveLabelNames(conf)...),
+			nil,
+		)
+	}
+
+	return &scrapeCollector{
+		aggregates: make(map[string]*taskAggregates),
+		api:        api,
+		config:     conf,
+		discovery:  discovery,
+		frameworkResources: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "framework", "resources"),
+			"Resources assigned to a framework",
+			[]string{"name", "resource", "type"},
+			nil,
+		),
+		httpClient:    c,
+		leaderMetrics: newLeaderMetrics(),
+		limiter:       limiter,
+		masterPoller: &masterPoller{
+			api:        api,
+			config:     conf,
+			detector:   detector,
+			httpClient: c,
+		},
+		mutex:    &sync.Mutex{},
+		previous: make(map[string]*Statistics),
+		slaveResources: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "slave", "resources"),
+			"Resources advertised by a slave",
+			slaveResourcesLabelNames(conf),
+			nil,
+		),
+		skippedTasks:   make(map[string]map[string]struct{}),
+		slaves:         make(map[string]Slave),
+		taskStatistics: taskStatisticDescs,
+		tasks: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "tasks"),
+			"Cluster-wide task metrics",
+			[]string{"status"},
+			nil,
+		),
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func collectMetrics(c prometheus.Collector) map[string][]*dto.Metric {
+	ch := make(chan prometheus.Metric)
+	metrics := make(map[string][]*dto.Metric)
+
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	for m := range ch {
+		out := &dto.Metric{}
+		m.Write(out)
+
+		name := m.Desc().String()
+		metrics[name] = append(metrics[name], out)
+	}
+
+	return metrics
+}
+
+func TestScrapeCollector(t *testing.T) {
+	var masterUrl *url.URL
+	var slaveUrl *url.URL
+
+	failed, finished, killed, lost, staged, started := 1.0, 2.0, 3.0, 4.0, 5.0, 6.0
+	throttled := 3.0
+
+	slave := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := []MonitoredTask{
+			{
+				ExecutorId:  "task1",
+				FrameworkId: "fw1",
+				Statistics:  Statistics{CpusLimit: 1.5, CpusNrThrottled: &throttled, MemRssBytes: 1024},
+			},
+			{
+				ExecutorId:  "unknown",
+				FrameworkId: "fw1",
+			},
+		}
+
+		data, _ := json.Marshal(stats)
+
+		w.Write(data)
+	}))
+	defer slave.Close()
+
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := Master{
+			FailedTasks:   &failed,
+			FinishedTasks: &finished,
+			KilledTasks:   &killed,
+			LostTasks:     &lost,
+			StagedTasks:   &staged,
+			StartedTasks:  &started,
+			Frameworks: []Framework{
+				{Id: "fw1", Name: "marathon", Tasks: []Task{{Id: "task1", Name: "redis"}}},
+			},
+			Leader: "master@" + masterUrl.Host,
+			Slaves: []Slave{{Pid: "slave(1)@" + slaveUrl.Host}},
+		}
+
+		data, _ := json.Marshal(m)
+
+		w.Write(data)
+	}))
+	defer master.Close()
+
+	masterUrl, _ = url.Parse(master.URL)
+	slaveUrl, _ = url.Parse(slave.URL)
+
+	c := newScrapeCollector(&http.Client{}, newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}), &Config{
+		ExporterScrapeTimeout: 5 * time.Second,
+		MesosMasters:          []*url.URL{masterUrl},
+		MesosSlaveConcurrency: 1,
+	}, nil, nil, nil)
+
+	metrics := collectMetrics(c)
+
+	count := 0
+	for _, m := range metrics {
+		count = count + len(m)
+	}
+
+	// 6 task states, 3 framework resources, 3 slave resources, 5 statistics that
+	// are always reported, one optional statistic, 5 requested resources and 3
+	// metrics about the leader
+	require.Equal(t, 6+3+3+5+1+5+3, count)
+
+	cpusLimit := metrics[c.taskStatistics[0].String()]
+	require.Len(t, cpusLimit, 1)
+	require.Equal(t, 1.5, cpusLimit[0].GetGauge().GetValue())
+}
+
+func TestScrapeCollectorDeadline(t *testing.T) {
+	var masterUrl *url.URL
+	var slaveUrl *url.URL
+
+	failed, finished, killed, lost, staged, started := 1.0, 2.0, 3.0, 4.0, 5.0, 6.0
+	block := make(chan struct{})
+
+	slave := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer slave.Close()
+	defer close(block)
+
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := Master{
+			FailedTasks:   &failed,
+			FinishedTasks: &finished,
+			KilledTasks:   &killed,
+			LostTasks:     &lost,
+			StagedTasks:   &staged,
+			StartedTasks:  &started,
+			Leader:        "master@" + masterUrl.Host,
+			Slaves:        []Slave{{Pid: "slave(1)@" + slaveUrl.Host}},
+		}
+
+		data, _ := json.Marshal(m)
+
+		w.Write(data)
+	}))
+	defer master.Close()
+
+	masterUrl, _ = url.Parse(master.URL)
+	slaveUrl, _ = url.Parse(slave.URL)
+
+	c := newScrapeCollector(&http.Client{}, newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}), &Config{
+		ExporterScrapeTimeout: 100 * time.Millisecond,
+		MesosMasters:          []*url.URL{masterUrl},
+		MesosSlaveConcurrency: 1,
+	}, nil, nil, nil)
+
+	start := time.Now()
+	metrics := collectMetrics(c)
+
+	require.True(t, time.Since(start) < 2*time.Second)
+	// Metrics of the master are still returned
+	require.Len(t, metrics[c.tasks.String()], 6)
+}
+
+// Masters that don't respond share the deadline of the scrape instead of getting
+// the whole scrape timeout each.
+func TestScrapeCollectorMasterDeadline(t *testing.T) {
+	block := make(chan struct{})
+
+	masters := []*url.URL{}
+	for i := 0; i < 5; i++ {
+		master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+		}))
+		defer master.Close()
+
+		masterUrl, _ := url.Parse(master.URL)
+		masters = append(masters, masterUrl)
+	}
+	defer close(block)
+
+	c := newScrapeCollector(&http.Client{}, newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}), &Config{
+		ExporterScrapeTimeout: 200 * time.Millisecond,
+		MesosMasters:          masters,
+		MesosSlaveConcurrency: 1,
+	}, nil, nil, nil)
+
+	start := time.Now()
+	metrics := collectMetrics(c)
+
+	require.True(t, time.Since(start) < 800*time.Millisecond, time.Since(start).String())
+	require.Len(t, metrics[c.tasks.String()], 0)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Ports that a task announces to service discovery tools.
+type Discovery struct {
+	Name  string
+	Ports struct {
+		Ports []DiscoveryPort
+	}
+}
+
+type DiscoveryPort struct {
+	Name     string
+	Number   int
+	Protocol string
+}
+
+// A group of targets in the format of Prometheus' file_sd_configs and http_sd_configs.
+type targetGroup struct {
+	Labels  map[string]string `json:"labels"`
+	Targets []string          `json:"targets"`
+}
+
+// Turns the ports of running tasks into scrape targets for Prometheus. Targets are
+// written to a file for file_sd_configs and served over HTTP for http_sd_configs.
+type serviceDiscovery struct {
+	config *Config
+	data   []byte
+	mutex  *sync.Mutex
+}
+
+// Recomputes the targets from the state of the master and rewrites the file if
+// the targets changed.
+func (d *serviceDiscovery) update(master Master) {
+	data, err := json.MarshalIndent(targetGroups(d.config, master), "", "  ")
+	if err != nil {
+		log.Errorf("Unable to encode service discovery targets: %s", err)
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if bytes.Equal(data, d.data) {
+		return
+	}
+
+	d.data = data
+
+	if d.config.SdFile == "" {
+		return
+	}
+
+	err = writeFileAtomic(d.config.SdFile, data)
+	if err != nil {
+		log.Errorf("Unable to write service discovery targets to '%s': %s", d.config.SdFile, err)
+	}
+}
+
+func (d *serviceDiscovery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mutex.Lock()
+	data := d.data
+	d.mutex.Unlock()
+
+	if data == nil {
+		data = []byte("[]")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func newServiceDiscovery(conf *Config) *serviceDiscovery {
+	return &serviceDiscovery{
+		config: conf,
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// One target group per port of a running task. Ports announced in the discovery
+// info of a task take precedence over the ports it has been assigned as resources.
+func targetGroups(conf *Config, master Master) []targetGroup {
+	hosts := make(map[string]string)
+	for _, slave := range master.Slaves {
+		host := slave.Hostname
+		if host == "" {
+			address, ok := slave.address()
+			if ok == false {
+				log.Warnf("Slave '%s' has neither a hostname nor a valid PID - skipping its tasks", slave.Id)
+				continue
+			}
+
+			host = strings.Split(address, ":")[0]
+		}
+
+		hosts[slave.Id] = host
+	}
+
+	groups := []targetGroup{}
+
+	for _, framework := range master.Frameworks {
+		for _, task := range framework.Tasks {
+			if task.State != "" && task.State != "TASK_RUNNING" {
+				continue
+			}
+
+			host, ok := hosts[task.SlaveId]
+			if ok == false {
+				continue
+			}
+
+			for _, port := range taskPorts(task) {
+				labels := map[string]string{
+					"agent_id":       task.SlaveId,
+					"framework":      framework.Name,
+					"slave_hostname": host,
+					"task":           task.Name,
+				}
+
+				if port.Name != "" {
+					labels["port_name"] = port.Name
+				}
+
+				for i, value := range task.labelValues(conf.MesosTaskLabels) {
+					labels[conf.MesosTaskLabelNames[i]] = value
+				}
+
+				groups = append(groups, targetGroup{
+					Labels:  labels,
+					Targets: []string{fmt.Sprintf("%s:%d", host, port.Number)},
+				})
+			}
+		}
+	}
+
+	// Tasks on slaves with the same hostname may share a target, so the labels
+	// are part of the order too
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].key() < groups[j].key()
+	})
+
+	return groups
+}
+
+// Orders groups by their targets first and then by their labels.
+func (g targetGroup) key() string {
+	names := []string{}
+	for name := range g.Labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	key := strings.Join(g.Targets, ",")
+	for _, name := range names {
+		key += "\x00" + name + "=" + g.Labels[name]
+	}
+
+	return key
+}
+
+func taskPorts(task Task) []DiscoveryPort {
+	if task.Discovery != nil && len(task.Discovery.Ports.Ports) > 0 {
+		return task.Discovery.Ports.Ports
+	}
+
+	ranges, err := parsePortRanges(task.Resources.Ports)
+	if err != nil {
+		log.Warnf("Ignoring ports of task '%s': %s", task.Id, err)
+		return nil
+	}
+
+	ports := []DiscoveryPort{}
+	for _, r := range ranges {
+		for number := r.begin; number <= r.end; number++ {
+			ports = append(ports, DiscoveryPort{Number: number})
+		}
+	}
+
+	return ports
+}
+
+// Writes to a temporary file first so that Prometheus never reads a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
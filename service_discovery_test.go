@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func discoveryMaster() Master {
+	announced := &Discovery{}
+	announced.Ports.Ports = []DiscoveryPort{{Name: "metrics", Number: 9100, Protocol: "tcp"}}
+
+	return Master{
+		Frameworks: []Framework{
+			{
+				Name: "marathon",
+				Tasks: []Task{
+					{
+						Id:        "redis.1",
+						Labels:    []Label{{Key: "team", Value: "cache"}},
+						Name:      "redis",
+						Resources: Resources{Ports: "[31000-31001]"},
+						SlaveId:   "s1",
+						State:     "TASK_RUNNING",
+					},
+					{
+						Discovery: announced,
+						Id:        "node.1",
+						Name:      "node-exporter",
+						Resources: Resources{Ports: "[31005-31005]"},
+						SlaveId:   "s2",
+						State:     "TASK_RUNNING",
+					},
+					{
+						Id:        "staging.1",
+						Name:      "staging",
+						Resources: Resources{Ports: "[31010-31010]"},
+						SlaveId:   "s1",
+						State:     "TASK_STAGING",
+					},
+				},
+			},
+		},
+		Slaves: []Slave{
+			{Hostname: "slave1.example.com", Id: "s1", Pid: "slave(1)@10.0.0.1:5051"},
+			{Id: "s2", Pid: "slave(1)@10.0.0.2:5051"},
+		},
+	}
+}
+
+func TestTargetGroups(t *testing.T) {
+	conf := &Config{MesosTaskLabels: []string{"team"}, MesosTaskLabelNames: []string{"team"}}
+
+	require.Equal(t, []targetGroup{
+		{
+			Labels:  map[string]string{"agent_id": "s2", "framework": "marathon", "port_name": "metrics", "slave_hostname": "10.0.0.2", "task": "node-exporter", "team": ""},
+			Targets: []string{"10.0.0.2:9100"},
+		},
+		{
+			Labels:  map[string]string{"agent_id": "s1", "framework": "marathon", "slave_hostname": "slave1.example.com", "task": "redis", "team": "cache"},
+			Targets: []string{"slave1.example.com:31000"},
+		},
+		{
+			Labels:  map[string]string{"agent_id": "s1", "framework": "marathon", "slave_hostname": "slave1.example.com", "task": "redis", "team": "cache"},
+			Targets: []string{"slave1.example.com:31001"},
+		},
+	}, targetGroups(conf, discoveryMaster()))
+
+	// Tasks on a slave without a hostname or address are left out
+	for _, pid := range []string{"", "slave(1)"} {
+		master := discoveryMaster()
+		master.Slaves[1].Pid = pid
+
+		require.Len(t, targetGroups(conf, master), 2, pid)
+	}
+
+	// Tasks on slaves that share a hostname have the same target and are told
+	// apart by their agent, in the same order whatever the order of the frameworks
+	master := Master{
+		Frameworks: []Framework{
+			{Name: "marathon", Tasks: []Task{{Name: "redis", Resources: Resources{Ports: "[31000-31000]"}, SlaveId: "s2"}}},
+			{Name: "aurora", Tasks: []Task{{Name: "redis", Resources: Resources{Ports: "[31000-31000]"}, SlaveId: "s1"}}},
+		},
+		Slaves: []Slave{
+			{Hostname: "slave.example.com", Id: "s1"},
+			{Hostname: "slave.example.com", Id: "s2"},
+		},
+	}
+
+	groups := targetGroups(&Config{}, master)
+	require.Len(t, groups, 2)
+	require.Equal(t, "s1", groups[0].Labels["agent_id"])
+	require.Equal(t, "s2", groups[1].Labels["agent_id"])
+
+	master.Frameworks[0], master.Frameworks[1] = master.Frameworks[1], master.Frameworks[0]
+	require.Equal(t, groups, targetGroups(&Config{}, master))
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesos-task-exporter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "targets.json")
+
+	d := newServiceDiscovery(&Config{SdFile: path})
+
+	// Nothing has been discovered yet
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest("GET", "/sd", nil))
+	require.Equal(t, "[]", w.Body.String())
+
+	d.update(discoveryMaster())
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	var groups []targetGroup
+	require.NoError(t, json.Unmarshal(data, &groups))
+	require.Len(t, groups, 3)
+
+	w = httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest("GET", "/sd", nil))
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	require.Equal(t, string(data), w.Body.String())
+
+	// Only the target file remains in the directory
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"io/ioutil"
 	"net/http"
-	"time"
 )
 
 const (
@@ -18,36 +17,361 @@ const (
 var labels = []string{"executor_id", "framework", "task"}
 
 type MonitoredTask struct {
+	// Only reported by the v1 Operator API
+	ContainerId string `json:"-"`
 	ExecutorId  string `json:"executor_id"`
 	FrameworkId string `json:"framework_id"`
-	Statistics  Statistics
+	// Whether the container is nested in the container of the executor, like the
+	// containers of a task group
+	Nested     bool `json:"-"`
+	Statistics Statistics
 }
 
+// Identifies the statistics among the ones reported by the same slave.
+func (t *MonitoredTask) key() string {
+	if t.Nested {
+		return t.ExecutorId + "/" + t.ContainerId
+	}
+
+	return t.ExecutorId
+}
+
+// Fields that are not reported by every slave are pointers so that a missing
+// field can be told apart from a value of zero.
 type Statistics struct {
-	CpusLimit          float64 `json:"cpus_limit"`
-	CpusSystemTimeSecs float64 `json:"cpus_system_time_secs"`
-	CpusUserTimeSecs   float64 `json:"cpus_user_time_secs"`
-	MemLimitBytes      int64   `json:"mem_limit_bytes"`
-	MemRssBytes        int64   `json:"mem_rss_bytes"`
-	Timestamp          float64
+	CpusLimit                  float64  `json:"cpus_limit"`
+	CpusNrPeriods              *float64 `json:"cpus_nr_periods"`
+	CpusNrThrottled            *float64 `json:"cpus_nr_throttled"`
+	CpusSystemTimeSecs         float64  `json:"cpus_system_time_secs"`
+	CpusThrottledTimeSecs      *float64 `json:"cpus_throttled_time_secs"`
+	CpusUserTimeSecs           float64  `json:"cpus_user_time_secs"`
+	DiskLimitBytes             *float64 `json:"disk_limit_bytes"`
+	DiskUsedBytes              *float64 `json:"disk_used_bytes"`
+	MemAnonBytes               *float64 `json:"mem_anon_bytes"`
+	MemCacheBytes              *float64 `json:"mem_cache_bytes"`
+	MemCriticalPressureCounter *float64 `json:"mem_critical_pressure_counter"`
+	MemFileBytes               *float64 `json:"mem_file_bytes"`
+	MemLimitBytes              int64    `json:"mem_limit_bytes"`
+	MemLowPressureCounter      *float64 `json:"mem_low_pressure_counter"`
+	MemMappedFileBytes         *float64 `json:"mem_mapped_file_bytes"`
+	MemMediumPressureCounter   *float64 `json:"mem_medium_pressure_counter"`
+	MemRssBytes                int64    `json:"mem_rss_bytes"`
+	MemSwapBytes               *float64 `json:"mem_swap_bytes"`
+	MemTotalBytes              *float64 `json:"mem_total_bytes"`
+	NetRxBytes                 *float64 `json:"net_rx_bytes"`
+	NetRxDropped               *float64 `json:"net_rx_dropped"`
+	NetRxErrors                *float64 `json:"net_rx_errors"`
+	NetRxPackets               *float64 `json:"net_rx_packets"`
+	NetTxBytes                 *float64 `json:"net_tx_bytes"`
+	NetTxDropped               *float64 `json:"net_tx_dropped"`
+	NetTxErrors                *float64 `json:"net_tx_errors"`
+	NetTxPackets               *float64 `json:"net_tx_packets"`
+	Timestamp                  float64
 }
 
-type taskMetric struct {
-	frameworkName string
-	taskName      string
+// Everything known about a task at the time its slave has been queried.
+type taskSample struct {
+	// Statistics of the previous query, nil if the task is new
+	previous   *Statistics
+	resources  Resources
+	statistics Statistics
 }
 
-func findTaskName(executorId string, framework Framework) string {
-	for _, task := range framework.Tasks {
-		if task.Id == executorId {
-			return task.Name
-		}
+// CPU time used per second since the previous sample.
+func (s taskSample) cpusUsage() (float64, bool) {
+	if s.previous == nil {
+		return 0, false
 	}
 
-	return ""
+	elapsed := s.statistics.Timestamp - s.previous.Timestamp
+	if elapsed <= 0 {
+		return 0, false
+	}
+
+	used := (s.statistics.CpusSystemTimeSecs + s.statistics.CpusUserTimeSecs) - (s.previous.CpusSystemTimeSecs + s.previous.CpusUserTimeSecs)
+
+	return used / elapsed, true
+}
+
+// A metric exported for every task, read from the statistics reported by a slave
+// or the resources the task requested. value returns false if the metric cannot
+// be calculated for the sample. Ratios can't be summed up over several tasks.
+type taskStatistic struct {
+	help      string
+	name      string
+	ratio     bool
+	valueType prometheus.ValueType
+	value     func(taskSample) (float64, bool)
 }
 
-func newCounterVec(constLabels prometheus.Labels, help string, name string) *prometheus.CounterVec {
+func ratio(used float64, requested float64) (float64, bool) {
+	if requested <= 0 {
+		return 0, false
+	}
+
+	return used / requested, true
+}
+
+func reported(v *float64) (float64, bool) {
+	if v == nil {
+		return 0, false
+	}
+
+	return *v, true
+}
+
+var taskStatistics = []taskStatistic{
+	{
+		help:      "CPU limit of the task.",
+		name:      "cpus_limit",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return s.statistics.CpusLimit, true },
+	},
+	{
+		help:      "Absolute CPU sytem time.",
+		name:      "cpus_system_time_seconds",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return s.statistics.CpusSystemTimeSecs, true },
+	},
+	{
+		help:      "Absolute CPU user time.",
+		name:      "cpus_user_time_seconds",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return s.statistics.CpusUserTimeSecs, true },
+	},
+	{
+		help:      "Maximum memory available to the task.",
+		name:      "mem_limit_bytes",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return float64(s.statistics.MemLimitBytes), true },
+	},
+	{
+		help:      "Current Memory usage.",
+		name:      "mem_rss_bytes",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return float64(s.statistics.MemRssBytes), true },
+	},
+	{
+		help:      "Number of CPU enforcement periods that have elapsed.",
+		name:      "cpus_periods",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.CpusNrPeriods) },
+	},
+	{
+		help:      "Number of CPU enforcement periods in which the task has been throttled.",
+		name:      "cpus_throttled_periods",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.CpusNrThrottled) },
+	},
+	{
+		help:      "Total time the task has been throttled.",
+		name:      "cpus_throttled_time_seconds",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.CpusThrottledTimeSecs) },
+	},
+	{
+		help:      "Disk space available to the task.",
+		name:      "disk_limit_bytes",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.DiskLimitBytes) },
+	},
+	{
+		help:      "Disk space used by the task.",
+		name:      "disk_used_bytes",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.DiskUsedBytes) },
+	},
+	{
+		help:      "Anonymous memory used by the task.",
+		name:      "mem_anon_bytes",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.MemAnonBytes) },
+	},
+	{
+		help:      "Page cache used by the task.",
+		name:      "mem_cache_bytes",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.MemCacheBytes) },
+	},
+	{
+		help:      "Number of times the task reached the critical memory pressure level.",
+		name:      "mem_critical_pressure",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.MemCriticalPressureCounter) },
+	},
+	{
+		help:      "File backed memory used by the task.",
+		name:      "mem_file_bytes",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.MemFileBytes) },
+	},
+	{
+		help:      "Number of times the task reached the low memory pressure level.",
+		name:      "mem_low_pressure",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.MemLowPressureCounter) },
+	},
+	{
+		help:      "Memory mapped files used by the task.",
+		name:      "mem_mapped_file_bytes",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.MemMappedFileBytes) },
+	},
+	{
+		help:      "Number of times the task reached the medium memory pressure level.",
+		name:      "mem_medium_pressure",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.MemMediumPressureCounter) },
+	},
+	{
+		help:      "Swap used by the task.",
+		name:      "mem_swap_bytes",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.MemSwapBytes) },
+	},
+	{
+		help:      "Total memory used by the task.",
+		name:      "mem_total_bytes",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.MemTotalBytes) },
+	},
+	{
+		help:      "Bytes received by the task.",
+		name:      "net_rx_bytes",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.NetRxBytes) },
+	},
+	{
+		help:      "Received packets dropped by the task.",
+		name:      "net_rx_dropped",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.NetRxDropped) },
+	},
+	{
+		help:      "Errors while receiving packets.",
+		name:      "net_rx_errors",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.NetRxErrors) },
+	},
+	{
+		help:      "Packets received by the task.",
+		name:      "net_rx_packets",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.NetRxPackets) },
+	},
+	{
+		help:      "Bytes sent by the task.",
+		name:      "net_tx_bytes",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.NetTxBytes) },
+	},
+	{
+		help:      "Sent packets dropped by the task.",
+		name:      "net_tx_dropped",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.NetTxDropped) },
+	},
+	{
+		help:      "Errors while sending packets.",
+		name:      "net_tx_errors",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.NetTxErrors) },
+	},
+	{
+		help:      "Packets sent by the task.",
+		name:      "net_tx_packets",
+		valueType: prometheus.CounterValue,
+		value:     func(s taskSample) (float64, bool) { return reported(s.statistics.NetTxPackets) },
+	},
+	{
+		help:      "CPUs requested by the task.",
+		name:      "requested_cpus",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return s.resources.Cpus, true },
+	},
+	{
+		help:      "Disk space requested by the task.",
+		name:      "requested_disk_bytes",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return s.resources.Disk * megabyte, true },
+	},
+	{
+		help:      "GPUs requested by the task.",
+		name:      "requested_gpus",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return s.resources.Gpus, true },
+	},
+	{
+		help:      "Memory requested by the task.",
+		name:      "requested_mem_bytes",
+		valueType: prometheus.GaugeValue,
+		value:     func(s taskSample) (float64, bool) { return s.resources.Mem * megabyte, true },
+	},
+	{
+		help:      "Number of ports requested by the task.",
+		name:      "requested_ports",
+		valueType: prometheus.GaugeValue,
+		value: func(s taskSample) (float64, bool) {
+			ranges, err := parsePortRanges(s.resources.Ports)
+			if err != nil {
+				return 0, false
+			}
+
+			return float64(countPorts(ranges)), true
+		},
+	},
+	{
+		help:      "CPU time used per second since the previous query divided by the CPUs requested by the task.",
+		name:      "cpus_utilisation_ratio",
+		ratio:     true,
+		valueType: prometheus.GaugeValue,
+		value: func(s taskSample) (float64, bool) {
+			usage, ok := s.cpusUsage()
+			if ok == false {
+				return 0, false
+			}
+
+			return ratio(usage, s.resources.Cpus)
+		},
+	},
+	{
+		help:      "Disk space used divided by the disk space requested by the task.",
+		name:      "disk_utilisation_ratio",
+		ratio:     true,
+		valueType: prometheus.GaugeValue,
+		value: func(s taskSample) (float64, bool) {
+			used, ok := reported(s.statistics.DiskUsedBytes)
+			if ok == false {
+				return 0, false
+			}
+
+			return ratio(used, s.resources.Disk*megabyte)
+		},
+	},
+	{
+		help:      "Resident memory divided by the memory requested by the task.",
+		name:      "mem_utilisation_ratio",
+		ratio:     true,
+		valueType: prometheus.GaugeValue,
+		value: func(s taskSample) (float64, bool) {
+			return ratio(float64(s.statistics.MemRssBytes), s.resources.Mem*megabyte)
+		},
+	},
+}
+
+// Implemented by both Gauge and Counter.
+type settableMetric interface {
+	Set(float64)
+}
+
+type taskMetric struct {
+	framework   string
+	labelValues []string
+	previous    *Statistics
+	resources   Resources
+}
+
+func newCounterVec(constLabels prometheus.Labels, labelNames []string, help string, name string) *prometheus.CounterVec {
 	counterVec := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			ConstLabels: constLabels,
@@ -56,14 +380,14 @@ func newCounterVec(constLabels prometheus.Labels, help string, name string) *pro
 			Namespace:   namespace,
 			Subsystem:   subsystem,
 		},
-		labels)
+		labelNames)
 
 	prometheus.MustRegister(counterVec)
 
 	return counterVec
 }
 
-func newGaugeVec(constLabels prometheus.Labels, help string, name string) *prometheus.GaugeVec {
+func newGaugeVec(constLabels prometheus.Labels, labelNames []string, help string, name string) *prometheus.GaugeVec {
 	gaugeVec := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			ConstLabels: constLabels,
@@ -72,13 +396,51 @@ func newGaugeVec(constLabels prometheus.Labels, help string, name string) *prome
 			Namespace:   namespace,
 			Subsystem:   subsystem,
 		},
-		labels)
+		labelNames)
 
 	prometheus.MustRegister(gaugeVec)
 
 	return gaugeVec
 }
 
+// Labels identifying a task.
+func taskLabelNames(conf *Config) []string {
+	return append(append([]string{}, labels...), conf.MesosTaskLabelNames...)
+}
+
+func taskLabelValues(conf *Config, executorId string, framework Framework, task Task) []string {
+	return append([]string{executorId, framework.Name, task.Name}, task.labelValues(conf.MesosTaskLabels)...)
+}
+
+// Labels identifying the slave a task is running on. The PID is only added with
+// -mesos.slave-pid-label as it changes whenever the slave restarts on another port.
+func slaveLabelNames(conf *Config) []string {
+	names := []string{"agent_id", "slave_hostname"}
+	if conf.MesosSlavePidLabel {
+		names = append(names, "slave_pid")
+	}
+
+	return append(names, conf.MesosSlaveAttributeLabels...)
+}
+
+func slaveLabelValues(conf *Config, slave Slave) []string {
+	values := []string{slave.Id, slave.Hostname}
+	if conf.MesosSlavePidLabel {
+		values = append(values, slave.Pid)
+	}
+
+	return append(values, slave.attributeValues(conf.MesosSlaveAttributes)...)
+}
+
+// Creates and registers a counter or a gauge, depending on the type of the statistic.
+func newTaskStatisticVec(constLabels prometheus.Labels, labelNames []string, statistic taskStatistic) *prometheus.MetricVec {
+	if statistic.valueType == prometheus.CounterValue {
+		return &newCounterVec(constLabels, labelNames, statistic.help, statistic.name).MetricVec
+	}
+
+	return &newGaugeVec(constLabels, labelNames, statistic.help, statistic.name).MetricVec
+}
+
 func retrieveStats(c *http.Client, stats *[]MonitoredTask, url string) error {
 	resp, err := c.Get(url)
 	if err != nil {
@@ -87,6 +449,10 @@ func retrieveStats(c *http.Client, stats *[]MonitoredTask, url string) error {
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{resp.StatusCode, fmt.Sprintf("Unexpected status code %d from '%s'", resp.StatusCode, url)}
+	}
+
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
@@ -100,130 +466,175 @@ func retrieveStats(c *http.Client, stats *[]MonitoredTask, url string) error {
 	return nil
 }
 
-// Periodically queries a Mesos slave and updates statistics of each running task
-func slavePoller(c *http.Client, conf *Config, frameworkRegistry *frameworkRegistry, slave Slave) {
-	var knownTasks map[string]taskMetric
-	var monitoredTasks []MonitoredTask
+// Statistics of the tasks on a Mesos slave, kept between polls. Tasks that are
+// filtered or that the slave runs no task for are skipped until they disappear, so
+// that they are neither resolved nor counted again. The poller is driven by a
+// slaveScheduler and only ever polled by one worker at a time.
+type slavePoller struct {
+	aggregates        *taskAggregates
+	api               *mesosApi
+	config            *Config
+	frameworkRegistry *frameworkRegistry
+	knownTasks        map[string]taskMetric
+	limiter           *taskLimiter
+	skippedTasks      map[string]struct{}
+	slave             Slave
+	statisticVecs     []*prometheus.MetricVec
+}
 
-	knownTasks = make(map[string]taskMetric)
+// Queries the slave once and updates statistics of each running task.
+func (p *slavePoller) poll(c *http.Client) error {
+	var monitoredTasks []MonitoredTask
 
-	slaveStatsUrl := fmt.Sprintf("http://%s/monitor/statistics.json", slave.address())
+	availableTasks := make(map[string]struct{})
+	skippedTasks := make(map[string]struct{})
 
-	constLabels := prometheus.Labels{"slave_pid": slave.Pid}
+	err := p.api.slaveStats(c, &monitoredTasks, p.slave)
+	if err != nil {
+		return err
+	}
 
-	cpusLimitGauge := newGaugeVec(
-		constLabels,
-		"CPU limit of the task.",
-		"cpus_limit",
-	)
+	aggregated := []aggregatedTask{}
 
-	cpusSystemTimeCounter := newCounterVec(
-		constLabels,
-		"Absolute CPU sytem time.",
-		"cpus_system_time_seconds",
-	)
+	resolver := newTaskResolver(c, p.api, p.frameworkRegistry, p.slave)
 
-	cpusUserTimeCounter := newCounterVec(
-		constLabels,
-		"Absolute CPU user time.",
-		"cpus_user_time_seconds",
-	)
+	for _, item := range withoutParentContainers(monitoredTasks) {
+		key := item.key()
+		availableTasks[key] = struct{}{}
 
-	memLimitGauge := newGaugeVec(
-		constLabels,
-		"Maximum memory available to the task.",
-		"mem_limit_bytes",
-	)
+		if _, ok := p.skippedTasks[key]; ok {
+			skippedTasks[key] = struct{}{}
+			continue
+		}
 
-	memRssGauge := newGaugeVec(
-		constLabels,
-		"Current Memory usage.",
-		"mem_rss_bytes",
-	)
+		metric, ok := p.knownTasks[key]
+		if ok == false {
+			framework, task, ok := resolver.resolve(item)
+			if ok == false {
+				log.Debugf("Task of executor '%s' of framework '%s' not registered - not scraping", item.ExecutorId, item.FrameworkId)
 
-	t := time.Tick(conf.MesosSlaveQueryInterval)
+				if resolver.unknown(item) {
+					skippedTasks[key] = struct{}{}
+				}
 
-	for _ = range t {
-		log.Debugf("Scraping slave '%s'", slave.Pid)
+				continue
+			}
 
-		availableTasks := make(map[string]struct{})
+			if p.config.Filters.keepTask(item.ExecutorId, framework, task) == false {
+				skippedTasks[key] = struct{}{}
+				continue
+			}
 
-		err := retrieveStats(c, &monitoredTasks, slaveStatsUrl)
-		if err != nil {
-			prometheus.Unregister(cpusLimitGauge)
-			prometheus.Unregister(cpusSystemTimeCounter)
-			prometheus.Unregister(cpusUserTimeCounter)
-			prometheus.Unregister(memLimitGauge)
-			prometheus.Unregister(memRssGauge)
+			log.Debugf("Found new task '%s' of executor '%s'", task.Id, item.ExecutorId)
 
-			log.Errorf("Error retrieving stats from slave '%s' - Stopping goroutine", slave.Pid)
-			return
+			metric = taskMetric{
+				framework:   framework.Name,
+				labelValues: taskLabelValues(p.config, item.ExecutorId, framework, task),
+				resources:   task.Resources,
+			}
 		}
 
-		for _, item := range monitoredTasks {
-			var frameworkName string
-			var taskName string
-
-			availableTasks[item.ExecutorId] = struct{}{}
-
-			cpusLimit := item.Statistics.CpusLimit
-			cpusSystemTime := item.Statistics.CpusSystemTimeSecs
-			cpusUserTime := item.Statistics.CpusUserTimeSecs
-			memLimit := float64(item.Statistics.MemLimitBytes)
-			memRss := float64(item.Statistics.MemRssBytes)
-
-			metric, ok := knownTasks[item.ExecutorId]
-			if ok {
-				frameworkName = metric.frameworkName
-				taskName = metric.taskName
-			} else {
-				framework, err := frameworkRegistry.Get(item.FrameworkId)
-				if err != nil {
-					log.Debugf("Framework '%s' of task '%s' not registered - not scraping", item.FrameworkId, item.ExecutorId)
-					continue
-				}
-
-				frameworkName = framework.Name
-				taskName = findTaskName(item.ExecutorId, framework)
+		sample := taskSample{
+			previous:   metric.previous,
+			resources:  metric.resources,
+			statistics: item.Statistics,
+		}
 
-				if taskName == "" {
-					log.Debugf("Could not find name of task of executor '%s' - skipping", item.ExecutorId)
-					continue
-				}
+		statistics := item.Statistics
+		metric.previous = &statistics
+		p.knownTasks[key] = metric
 
-				log.Debugf("Found new task '%s'", item.ExecutorId)
+		switch p.limiter.admit(p.slave, key, metric.framework) {
+		case taskAggregated:
+			aggregated = append(aggregated, aggregatedTask{key, metric.labelValues, sample})
+			continue
+		case taskDropped:
+			continue
+		}
 
-				knownTasks[item.ExecutorId] = taskMetric{
-					frameworkName: frameworkName,
-					taskName:      taskName,
-				}
+		for i, statistic := range taskStatistics {
+			value, ok := statistic.value(sample)
+			if ok == false {
+				p.statisticVecs[i].DeleteLabelValues(metric.labelValues...)
+				continue
 			}
 
-			cpusLimitGauge.WithLabelValues(item.ExecutorId, frameworkName, taskName).Set(cpusLimit)
+			p.statisticVecs[i].WithLabelValues(metric.labelValues...).(settableMetric).Set(value)
+		}
+	}
 
-			cpusSystemTimeCounter.WithLabelValues(item.ExecutorId, frameworkName, taskName).Set(cpusSystemTime)
+	p.limiter.retain(p.slave, availableTasks)
+	p.skippedTasks = skippedTasks
 
-			cpusUserTimeCounter.WithLabelValues(item.ExecutorId, frameworkName, taskName).Set(cpusUserTime)
+	removed := p.aggregates.update(aggregated)
 
-			memLimitGauge.WithLabelValues(item.ExecutorId, frameworkName, taskName).Set(memLimit)
+	for _, aggregate := range p.aggregates.series {
+		for i, value := range aggregate.values {
+			if value == nil {
+				p.statisticVecs[i].DeleteLabelValues(aggregate.labelValues...)
+				continue
+			}
 
-			memRssGauge.WithLabelValues(item.ExecutorId, frameworkName, taskName).Set(memRss)
+			p.statisticVecs[i].WithLabelValues(aggregate.labelValues...).(settableMetric).Set(*value)
 		}
+	}
 
-		// Remove tasks that have finished since the last check and unregister the metrics associated with the task
-		for executorId, metric := range knownTasks {
-			_, ok := availableTasks[executorId]
-			if ok == false {
-				log.Debugf("Removing finished task '%s'", executorId)
+	for _, labelValues := range removed {
+		for _, vec := range p.statisticVecs {
+			vec.DeleteLabelValues(labelValues...)
+		}
+	}
 
-				cpusLimitGauge.DeleteLabelValues(executorId, metric.frameworkName, metric.taskName)
-				cpusSystemTimeCounter.DeleteLabelValues(executorId, metric.frameworkName, metric.taskName)
-				cpusUserTimeCounter.DeleteLabelValues(executorId, metric.frameworkName, metric.taskName)
-				memLimitGauge.DeleteLabelValues(executorId, metric.frameworkName, metric.taskName)
-				memRssGauge.DeleteLabelValues(executorId, metric.frameworkName, metric.taskName)
+	// Remove tasks that have finished since the last check and unregister the metrics associated with the task
+	for key, metric := range p.knownTasks {
+		_, ok := availableTasks[key]
+		if ok == false {
+			log.Debugf("Removing finished task '%s'", key)
 
-				delete(knownTasks, executorId)
+			for _, vec := range p.statisticVecs {
+				vec.DeleteLabelValues(metric.labelValues...)
 			}
+
+			delete(p.knownTasks, key)
 		}
 	}
+
+	return nil
+}
+
+// Unregisters the metrics of the tasks on the slave.
+func (p *slavePoller) close() {
+	for _, vec := range p.statisticVecs {
+		prometheus.Unregister(vec)
+	}
+
+	p.limiter.releaseSlave(p.slave)
+}
+
+// Registers the metrics of the tasks on the slave, labelled with the slave.
+func newSlavePoller(api *mesosApi, conf *Config, frameworkRegistry *frameworkRegistry, limiter *taskLimiter, slave Slave) *slavePoller {
+	constLabels := prometheus.Labels{}
+	slaveLabels := slaveLabelNames(conf)
+	for i, value := range slaveLabelValues(conf, slave) {
+		constLabels[slaveLabels[i]] = value
+	}
+
+	labelNames := taskLabelNames(conf)
+
+	statisticVecs := make([]*prometheus.MetricVec, len(taskStatistics))
+	for i, statistic := range taskStatistics {
+		statisticVecs[i] = newTaskStatisticVec(constLabels, labelNames, statistic)
+	}
+
+	return &slavePoller{
+		aggregates:        newTaskAggregates(conf),
+		api:               api,
+		config:            conf,
+		frameworkRegistry: frameworkRegistry,
+		knownTasks:        make(map[string]taskMetric),
+		limiter:           limiter,
+		skippedTasks:      make(map[string]struct{}),
+		slave:             slave,
+		statisticVecs:     statisticVecs,
+	}
 }
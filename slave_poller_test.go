@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func findTaskStatistic(name string) taskStatistic {
+	for _, statistic := range taskStatistics {
+		if statistic.name == name {
+			return statistic
+		}
+	}
+
+	return taskStatistic{}
+}
+
+func TestTaskUtilisation(t *testing.T) {
+	sample := taskSample{
+		previous: &Statistics{
+			CpusSystemTimeSecs: 1,
+			CpusUserTimeSecs:   1,
+			Timestamp:          100,
+		},
+		resources: Resources{Cpus: 0.5, Mem: 256},
+		statistics: Statistics{
+			CpusSystemTimeSecs: 2,
+			CpusUserTimeSecs:   2,
+			MemRssBytes:        64 * megabyte,
+			Timestamp:          110,
+		},
+	}
+
+	cpus, ok := findTaskStatistic("cpus_utilisation_ratio").value(sample)
+	require.True(t, ok)
+	require.InDelta(t, 0.4, cpus, 0.0001)
+
+	mem, ok := findTaskStatistic("mem_utilisation_ratio").value(sample)
+	require.True(t, ok)
+	require.Equal(t, 0.25, mem)
+
+	// Disk usage is not reported
+	_, ok = findTaskStatistic("disk_utilisation_ratio").value(sample)
+	require.False(t, ok)
+
+	// No rate can be calculated for the first sample of a task
+	sample.previous = nil
+	_, ok = findTaskStatistic("cpus_utilisation_ratio").value(sample)
+	require.False(t, ok)
+}
+
+func TestSlavePollerSkippedTasks(t *testing.T) {
+	stats := []MonitoredTask{
+		{ExecutorId: "web.1", FrameworkId: "fw1"},
+		{ExecutorId: "sidecar.1", FrameworkId: "fw1"},
+		{ExecutorId: "custom.1", FrameworkId: "fw1"},
+		{ExecutorId: "new.1", FrameworkId: "fw2"},
+	}
+
+	stateCount := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/monitor/statistics.json":
+			data, _ := json.Marshal(stats)
+			w.Write(data)
+		case "/state.json":
+			stateCount = stateCount + 1
+			w.Write([]byte(`{"frameworks": [{"id": "fw1", "executors": [{"id": "web.1", "tasks": [{"id": "web.1"}]}]}]}`))
+		}
+	}))
+	defer ts.Close()
+
+	slaveUrl, _ := url.Parse(ts.URL)
+
+	taskName, _ := newFilterRule("", "sidecar-.*")
+	filters := newItemFilters(map[string]filterRule{"task-name": taskName})
+
+	frameworks := NewFrameworkRegistry(0)
+	frameworks.Replace([]Framework{
+		{Id: "fw1", Name: "marathon", Tasks: []Task{{Id: "web.1", Name: "web"}, {Id: "sidecar.1", Name: "sidecar-logs"}}},
+	})
+
+	conf := &Config{Filters: filters, MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}
+
+	p := newSlavePoller(newMesosApi(conf), conf, frameworks, nil, Slave{Id: "skipped-tasks", Pid: "slave(1)@" + slaveUrl.Host})
+	defer p.close()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, p.poll(&http.Client{}))
+	}
+
+	// The filtered task and the executor the slave runs no task for are only
+	// looked at once. The framework that is not registered yet might be later.
+	require.Equal(t, map[string]struct{}{"sidecar.1": {}, "custom.1": {}}, p.skippedTasks)
+	require.Equal(t, 1.0, filteredItems(t, filters, filteredTask))
+	require.Equal(t, 1, stateCount)
+	require.Len(t, p.knownTasks, 1)
+
+	// Skipped tasks are forgotten once they disappear
+	stats = stats[:1]
+
+	require.NoError(t, p.poll(&http.Client{}))
+	require.Len(t, p.skippedTasks, 0)
+}
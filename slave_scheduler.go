@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A slave polled by a slaveScheduler.
+type scheduledSlave struct {
+	// Number of times the poller has been restarted in a row
+	attempt int
+	// Cancels the requests of a poll in progress once the slave is removed
+	cancel   context.CancelFunc
+	ctx      context.Context
+	failures int
+	// Held while the slave is polled
+	mutex   *sync.Mutex
+	poller  *slavePoller
+	started time.Time
+	stopped bool
+	timer   *time.Timer
+}
+
+// Polls the tasks of all slaves with a fixed number of workers, so that a large
+// cluster is not queried all at once and a slave that does not respond only
+// blocks a worker until the request timed out. The first poll of a slave happens
+// at a random offset within the interval to spread the polls of all slaves.
+// A poller that failed MesosSlaveFailureLimit times in a row is restarted after an
+// exponentially growing, jittered delay.
+type slaveScheduler struct {
+	api               *mesosApi
+	cancel            context.CancelFunc
+	config            *Config
+	ctx               context.Context
+	frameworkRegistry *frameworkRegistry
+	httpClient        *http.Client
+	limiter           *taskLimiter
+	mutex             *sync.Mutex
+	// Slaves that are due to be polled
+	queue   []*scheduledSlave
+	ready   chan struct{}
+	slaves  map[string]*scheduledSlave
+	workers *sync.WaitGroup
+}
+
+// Starts polling the slave.
+func (s *slaveScheduler) add(slave Slave) {
+	ctx, cancel := context.WithCancel(s.ctx)
+
+	item := &scheduledSlave{
+		cancel:  cancel,
+		ctx:     ctx,
+		mutex:   &sync.Mutex{},
+		poller:  newSlavePoller(s.api, s.config, s.frameworkRegistry, s.limiter, slave),
+		started: time.Now(),
+	}
+
+	s.mutex.Lock()
+	s.slaves[slave.key()] = item
+	s.mutex.Unlock()
+
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+
+	offset := time.Duration(0)
+	if interval := s.config.slaveQueryInterval(); interval > 0 {
+		offset = time.Duration(rand.Int63n(int64(interval)))
+	}
+
+	s.schedule(item, offset)
+}
+
+// Delay before the given restart attempt. The delay doubles with every attempt,
+// is capped at MesosSlaveBackoffMax and is randomized to avoid restarting the
+// pollers of many slaves at the same time.
+func (s *slaveScheduler) backoff(attempt int) time.Duration {
+	d, max := s.config.slaveBackoff()
+	for i := 0; i < attempt && d < max; i++ {
+		d = d * 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	// Pick a delay between d/2 and d
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Returns the next slave that is due, waiting for one if there is none. Returns
+// false once the scheduler is stopped.
+func (s *slaveScheduler) next() (*scheduledSlave, bool) {
+	for {
+		s.mutex.Lock()
+		if len(s.queue) > 0 {
+			item := s.queue[0]
+			s.queue = s.queue[1:]
+			more := len(s.queue) > 0
+			s.mutex.Unlock()
+
+			// Wake up another worker for the rest of the queue
+			if more {
+				s.wake()
+			}
+
+			return item, true
+		}
+		s.mutex.Unlock()
+
+		select {
+		case <-s.ctx.Done():
+			return nil, false
+		case <-s.ready:
+		}
+	}
+}
+
+// Polls the slave once within the poll timeout and schedules its next poll.
+func (s *slaveScheduler) poll(item *scheduledSlave) {
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+
+	if item.stopped {
+		return
+	}
+
+	slave := item.poller.slave
+	started := time.Now()
+	interval := s.config.slaveQueryInterval()
+	requestTimeout, pollTimeout := s.config.slaveTimeouts()
+
+	ctx, cancel := context.WithTimeout(item.ctx, pollTimeout)
+	defer cancel()
+
+	log.Debugf("Scraping slave '%s'", slave.Pid)
+
+	err := item.poller.poll(newDeadlineClient(ctx, s.httpClient, requestTimeout))
+	if err == nil {
+		item.failures = 0
+		s.schedule(item, interval-time.Since(started))
+		return
+	}
+
+	// The slave has been removed while it was polled
+	if item.ctx.Err() != nil {
+		return
+	}
+
+	item.failures = item.failures + 1
+
+	if limit := s.config.slaveFailureLimit(); item.failures < limit {
+		log.Warnf("Error retrieving stats from slave '%s' (%d/%d): %s", slave.Pid, item.failures, limit, err)
+		s.schedule(item, interval-time.Since(started))
+		return
+	}
+
+	// A poller that kept running for a while is considered healthy again
+	if _, max := s.config.slaveBackoff(); time.Since(item.started) > max {
+		item.attempt = 0
+	}
+
+	delay := s.backoff(item.attempt)
+	item.attempt = item.attempt + 1
+
+	log.Errorf("Error retrieving stats from slave '%s' %d times in a row: %s - Restarting poller in %s", slave.Pid, item.failures, err, delay)
+
+	item.poller.close()
+	item.poller = newSlavePoller(s.api, s.config, s.frameworkRegistry, s.limiter, slave)
+	item.failures = 0
+	item.started = time.Now().Add(delay)
+
+	s.schedule(item, delay+interval)
+}
+
+// Stops polling the slave and waits until its metrics are unregistered.
+func (s *slaveScheduler) remove(slave Slave) {
+	s.mutex.Lock()
+	item, ok := s.slaves[slave.key()]
+	delete(s.slaves, slave.key())
+	s.mutex.Unlock()
+
+	if ok {
+		s.stop(item)
+	}
+}
+
+// Queues the slave once the delay passed. Must be called with the mutex of the
+// slave held.
+func (s *slaveScheduler) schedule(item *scheduledSlave, delay time.Duration) {
+	item.timer = time.AfterFunc(delay, func() {
+		s.mutex.Lock()
+		s.queue = append(s.queue, item)
+		s.mutex.Unlock()
+
+		s.wake()
+	})
+}
+
+func (s *slaveScheduler) stop(item *scheduledSlave) {
+	item.cancel()
+
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+
+	item.stopped = true
+	item.timer.Stop()
+	item.poller.close()
+}
+
+func (s *slaveScheduler) wake() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (s *slaveScheduler) work() {
+	defer s.workers.Done()
+
+	for {
+		item, ok := s.next()
+		if ok == false {
+			return
+		}
+
+		s.poll(item)
+	}
+}
+
+// Stops the workers and waits until the metrics of all slaves are unregistered.
+func (s *slaveScheduler) Stop() {
+	s.cancel()
+	s.workers.Wait()
+
+	s.mutex.Lock()
+	slaves := s.slaves
+	s.slaves = make(map[string]*scheduledSlave)
+	s.mutex.Unlock()
+
+	for _, item := range slaves {
+		s.stop(item)
+	}
+}
+
+// Starts MesosSlaveConcurrency workers. They also stop once ctx is cancelled.
+func newSlaveScheduler(ctx context.Context, c *http.Client, api *mesosApi, conf *Config, frameworkRegistry *frameworkRegistry, limiter *taskLimiter) *slaveScheduler {
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &slaveScheduler{
+		api:               api,
+		cancel:            cancel,
+		config:            conf,
+		ctx:               ctx,
+		frameworkRegistry: frameworkRegistry,
+		httpClient:        c,
+		limiter:           limiter,
+		mutex:             &sync.Mutex{},
+		ready:             make(chan struct{}, 1),
+		slaves:            make(map[string]*scheduledSlave),
+		workers:           &sync.WaitGroup{},
+	}
+
+	for i := 0; i < conf.MesosSlaveConcurrency; i++ {
+		s.workers.Add(1)
+		go s.work()
+	}
+
+	return s
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlaveSchedulerBackoff(t *testing.T) {
+	s := slaveScheduler{
+		config: &Config{
+			MesosSlaveBackoff:    1 * time.Second,
+			MesosSlaveBackoffMax: 10 * time.Second,
+		},
+	}
+
+	for attempt, max := range []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		d := s.backoff(attempt)
+
+		require.True(t, d >= max/2, "attempt %d: %s < %s", attempt, d, max/2)
+		require.True(t, d <= max, "attempt %d: %s > %s", attempt, d, max)
+	}
+}
+
+func TestSlaveSchedulerRestartsPoller(t *testing.T) {
+	mutex := &sync.Mutex{}
+	reqCount := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		reqCount = reqCount + 1
+
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	slaveUrl, _ := url.Parse(ts.URL)
+
+	s := newSlaveScheduler(
+		context.Background(),
+		&http.Client{},
+		newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}),
+		&Config{
+			MesosSlaveBackoff:       1 * time.Millisecond,
+			MesosSlaveBackoffMax:    2 * time.Millisecond,
+			MesosSlaveConcurrency:   1,
+			MesosSlaveFailureLimit:  2,
+			MesosSlaveQueryInterval: 1 * time.Millisecond,
+		},
+		NewFrameworkRegistry(0),
+		nil,
+	)
+
+	s.add(Slave{Pid: "slave(1)@" + slaveUrl.Host})
+
+	// Each run of the poller gives up after two failed requests, so more than
+	// two requests prove that the poller has been restarted.
+	require.True(t, waitFor(func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return reqCount > 4
+	}))
+
+	s.Stop()
+}
+
+func TestSlaveSchedulerConcurrency(t *testing.T) {
+	mutex := &sync.Mutex{}
+	inFlight := 0
+	maxInFlight := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inFlight = inFlight + 1
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mutex.Lock()
+		inFlight = inFlight - 1
+		mutex.Unlock()
+
+		w.Write([]byte("[]"))
+	}))
+	defer ts.Close()
+
+	slaveUrl, _ := url.Parse(ts.URL)
+
+	s := newSlaveScheduler(
+		context.Background(),
+		&http.Client{},
+		newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}),
+		&Config{
+			MesosSlaveConcurrency:   2,
+			MesosSlaveFailureLimit:  3,
+			MesosSlavePollTimeout:   5 * time.Second,
+			MesosSlaveQueryInterval: 10 * time.Millisecond,
+		},
+		NewFrameworkRegistry(0),
+		nil,
+	)
+
+	// All slaves are reached at the same address
+	for i := 0; i < 10; i++ {
+		s.add(Slave{Id: fmt.Sprintf("s%d", i), Pid: "slave(1)@" + slaveUrl.Host})
+	}
+
+	require.True(t, waitFor(func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return maxInFlight >= 2
+	}))
+
+	s.Stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	require.Equal(t, 2, maxInFlight)
+}
+
+func TestSlaveSchedulerRequestTimeout(t *testing.T) {
+	block := make(chan struct{})
+	mutex := &sync.Mutex{}
+	reqCount := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		reqCount = reqCount + 1
+		mutex.Unlock()
+
+		// The slave never responds
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	slaveUrl, _ := url.Parse(ts.URL)
+
+	s := newSlaveScheduler(
+		context.Background(),
+		&http.Client{},
+		newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}),
+		&Config{
+			MesosSlaveConcurrency:    1,
+			MesosSlaveFailureLimit:   100,
+			MesosSlaveQueryInterval:  1 * time.Millisecond,
+			MesosSlaveRequestTimeout: 10 * time.Millisecond,
+		},
+		NewFrameworkRegistry(0),
+		nil,
+	)
+
+	s.add(Slave{Pid: "slave(1)@" + slaveUrl.Host})
+
+	// A slave that does not respond is polled again once the request timed out
+	require.True(t, waitFor(func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return reqCount > 2
+	}))
+
+	s.Stop()
+}
+
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	return false
+}
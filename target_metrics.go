@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	kindMaster = "master"
+	kindSlave  = "slave"
+
+	errorClassConnect    = "connect"
+	errorClassDecode     = "decode"
+	errorClassHttpStatus = "http_status"
+	errorClassOther      = "other"
+	errorClassSize       = "response_size"
+	errorClassTimeout    = "timeout"
+)
+
+var errorClasses = []string{errorClassConnect, errorClassDecode, errorClassHttpStatus, errorClassOther, errorClassSize, errorClassTimeout}
+
+// Returned when Mesos responds with a status code other than 200.
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// Returned when a response of Mesos exceeds -mesos.max-response-size.
+type responseSizeError struct {
+	limit int64
+	url   string
+}
+
+func (e *responseSizeError) Error() string {
+	return fmt.Sprintf("Response from '%s' exceeds the maximum size of %d bytes", e.url, e.limit)
+}
+
+// Metrics about the requests of the exporter to Mesos masters and slaves, so that
+// targets the exporter can't see are visible.
+type targetMetrics struct {
+	duration     *prometheus.HistogramVec
+	errors       *prometheus.CounterVec
+	lastSuccess  *prometheus.GaugeVec
+	responseSize *prometheus.HistogramVec
+	up           *prometheus.GaugeVec
+}
+
+func (m *targetMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.duration.Describe(ch)
+	m.errors.Describe(ch)
+	m.lastSuccess.Describe(ch)
+	m.responseSize.Describe(ch)
+	m.up.Describe(ch)
+}
+
+func (m *targetMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.duration.Collect(ch)
+	m.errors.Collect(ch)
+	m.lastSuccess.Collect(ch)
+	m.responseSize.Collect(ch)
+	m.up.Collect(ch)
+}
+
+// Records the outcome of querying a target.
+func (m *targetMetrics) observe(kind string, target string, duration time.Duration, size int64, err error) {
+	m.duration.WithLabelValues(kind).Observe(duration.Seconds())
+	m.responseSize.WithLabelValues(kind).Observe(float64(size))
+
+	if err != nil {
+		m.errors.WithLabelValues(kind, target, errorClass(err)).Inc()
+		m.up.WithLabelValues(kind, target).Set(0)
+		return
+	}
+
+	m.lastSuccess.WithLabelValues(kind, target).Set(float64(time.Now().UnixNano()) / 1e9)
+	m.up.WithLabelValues(kind, target).Set(1)
+}
+
+// Removes the metrics of a target that left the cluster.
+func (m *targetMetrics) remove(kind string, target string) {
+	for _, class := range errorClasses {
+		m.errors.DeleteLabelValues(kind, target, class)
+	}
+
+	m.lastSuccess.DeleteLabelValues(kind, target)
+	m.up.DeleteLabelValues(kind, target)
+}
+
+func newTargetMetrics() *targetMetrics {
+	return &targetMetrics{
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Buckets:   []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+				Help:      "Time it took to query a Mesos master or slave",
+				Name:      "target_scrape_duration_seconds",
+				Namespace: namespace,
+				Subsystem: "exporter",
+			},
+			[]string{"kind"}),
+		errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Help:      "Failed queries of a Mesos master or slave by class of error",
+				Name:      "target_errors",
+				Namespace: namespace,
+				Subsystem: "exporter",
+			},
+			[]string{"kind", "target", "class"}),
+		lastSuccess: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Help:      "Time of the last successful query of a Mesos master or slave in seconds since the epoch",
+				Name:      "target_last_success_timestamp_seconds",
+				Namespace: namespace,
+				Subsystem: "exporter",
+			},
+			[]string{"kind", "target"}),
+		responseSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+				Help:      "Bytes received from a Mesos master or slave per query",
+				Name:      "target_response_size_bytes",
+				Namespace: namespace,
+				Subsystem: "exporter",
+			},
+			[]string{"kind"}),
+		up: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Help:      "Whether the last query of a Mesos master or slave succeeded",
+				Name:      "target_up",
+				Namespace: namespace,
+				Subsystem: "exporter",
+			},
+			[]string{"kind", "target"}),
+	}
+}
+
+func errorClass(err error) string {
+	var sizeErr *responseSizeError
+	var statusErr *statusError
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var urlErr *url.Error
+
+	switch {
+	case errors.As(err, &statusErr):
+		return errorClassHttpStatus
+	case errors.As(err, &sizeErr):
+		return errorClassSize
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errorClassTimeout
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return errorClassDecode
+	case errors.As(err, &urlErr):
+		return errorClassConnect
+	}
+
+	return errorClassOther
+}
+
+// Counts the bytes of all response bodies read through it. Bodies larger than
+// limit fail to be read - unless limit is 0.
+type countingTransport struct {
+	bytes int64
+	limit int64
+	next  http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	url := req.URL.String()
+
+	// Don't wait for a body that is known to be too large
+	if t.limit > 0 && resp.ContentLength > t.limit {
+		resp.Body.Close()
+		return nil, &responseSizeError{t.limit, url}
+	}
+
+	resp.Body = &countingReader{ReadCloser: resp.Body, bytes: &t.bytes, limit: t.limit, url: url}
+
+	return resp, nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	bytes *int64
+	limit int64
+	read  int64
+	url   string
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.bytes, int64(n))
+
+	r.read = r.read + int64(n)
+	if r.limit > 0 && r.read > r.limit {
+		return n, &responseSizeError{r.limit, r.url}
+	}
+
+	return n, err
+}
+
+// Runs the requests for one query of a target with a client that counts the bytes
+// received and records the outcome in the target metrics. Responses are limited to
+// limit bytes each.
+func instrument(m *targetMetrics, c *http.Client, kind string, target string, limit int64, query func(c *http.Client) error) error {
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	counter := &countingTransport{limit: limit, next: next}
+
+	instrumented := *c
+	instrumented.Transport = counter
+
+	start := time.Now()
+
+	err := query(&instrumented)
+
+	m.observe(kind, target, time.Since(start), atomic.LoadInt64(&counter.bytes), err)
+
+	return err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func gaugeValue(t *testing.T, m prometheus.Metric) float64 {
+	out := &dto.Metric{}
+	require.NoError(t, m.Write(out))
+
+	return out.GetGauge().GetValue()
+}
+
+func TestErrorClass(t *testing.T) {
+	block := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/block":
+			<-block
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte("{invalid"))
+		}
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	c := &http.Client{Timeout: 50 * time.Millisecond}
+
+	var master Master
+
+	require.Equal(t, errorClassHttpStatus, errorClass(retrieveStats(c, nil, ts.URL+"/error")))
+	require.Equal(t, errorClassTimeout, errorClass(retrieveStats(c, nil, ts.URL+"/block")))
+	require.Equal(t, errorClassDecode, errorClass(retrieveMasterState(c, &master, ts.URL)))
+	require.Equal(t, errorClassConnect, errorClass(retrieveMasterState(c, &master, closed.URL)))
+	require.Equal(t, errorClassOther, errorClass(errors.New("No Mesos master leader known")))
+}
+
+func TestTargetMetrics(t *testing.T) {
+	fail := false
+	body := `[{"executor_id": "task1", "framework_id": "fw1", "statistics": {"cpus_limit": 1}}]`
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	slaveUrl, _ := url.Parse(ts.URL)
+	slave := Slave{Pid: "slave(1)@" + slaveUrl.Host}
+
+	api := newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"})
+
+	var stats []MonitoredTask
+	require.NoError(t, api.slaveStats(&http.Client{}, &stats, slave))
+
+	require.Equal(t, 1.0, gaugeValue(t, api.metrics.up.WithLabelValues(kindSlave, slave.Pid)))
+	require.InDelta(t, float64(time.Now().Unix()), gaugeValue(t, api.metrics.lastSuccess.WithLabelValues(kindSlave, slave.Pid)), 5)
+
+	size := &dto.Metric{}
+	api.metrics.responseSize.WithLabelValues(kindSlave).Write(size)
+	require.Equal(t, uint64(1), size.GetHistogram().GetSampleCount())
+	require.Equal(t, float64(len(body)), size.GetHistogram().GetSampleSum())
+
+	fail = true
+	require.Error(t, api.slaveStats(&http.Client{}, &stats, slave))
+
+	require.Equal(t, 0.0, gaugeValue(t, api.metrics.up.WithLabelValues(kindSlave, slave.Pid)))
+
+	errs := &dto.Metric{}
+	api.metrics.errors.WithLabelValues(kindSlave, slave.Pid, errorClassHttpStatus).Write(errs)
+	require.Equal(t, 1.0, errs.GetCounter().GetValue())
+
+	duration := &dto.Metric{}
+	api.metrics.duration.WithLabelValues(kindSlave).Write(duration)
+	require.Equal(t, uint64(2), duration.GetHistogram().GetSampleCount())
+
+	// Only the histograms remain once the slave is gone
+	api.removeSlave(slave)
+
+	metrics := collectMetrics(api.metrics)
+
+	count := 0
+	for _, m := range metrics {
+		count = count + len(m)
+	}
+
+	require.Equal(t, 2, count)
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	body := `[{"executor_id": "task1", "framework_id": "fw1", "statistics": {"cpus_limit": 1}}]`
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Responses of unknown size are cut off while they are read
+		if r.URL.Path == "/chunked/monitor/statistics.json" {
+			w.(http.Flusher).Flush()
+		}
+
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	slaveUrl, _ := url.Parse(ts.URL)
+	slave := Slave{Pid: "slave(1)@" + slaveUrl.Host}
+
+	conf := &Config{MesosApiVersion: apiVersionV0, MesosMaxResponseSize: int64(len(body)), MesosSlaveScheme: "http"}
+
+	var stats []MonitoredTask
+	require.NoError(t, newMesosApi(conf).slaveStats(&http.Client{}, &stats, slave))
+
+	conf.MesosMaxResponseSize = 10
+
+	for _, path := range []string{"", "/chunked"} {
+		conf.MesosSlaveUrlTemplate = template.Must(template.New("slave-url").Parse(ts.URL + path))
+
+		api := newMesosApi(conf)
+
+		err := api.slaveStats(&http.Client{}, &stats, slave)
+		require.Equal(t, errorClassSize, errorClass(err), path)
+
+		errs := &dto.Metric{}
+		api.metrics.errors.WithLabelValues(kindSlave, slave.Pid, errorClassSize).Write(errs)
+		require.Equal(t, 1.0, errs.GetCounter().GetValue())
+	}
+}
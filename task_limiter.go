@@ -0,0 +1,353 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"sync"
+)
+
+const (
+	overflowAggregate = "aggregate"
+	overflowDrop      = "drop"
+
+	// Executor ID, task name and task label values of the series that tasks over
+	// the limit are aggregated into
+	aggregatedLabelValue = "other"
+)
+
+// What happens to the series of a task.
+type taskLimitState int
+
+const (
+	taskExported taskLimitState = iota
+	taskAggregated
+	taskDropped
+)
+
+func (s taskLimitState) String() string {
+	switch s {
+	case taskAggregated:
+		return "aggregated"
+	case taskDropped:
+		return "dropped"
+	}
+
+	return "exported"
+}
+
+type limitedTask struct {
+	framework string
+	state     taskLimitState
+}
+
+type taskCount struct {
+	framework string
+	state     taskLimitState
+}
+
+// Caps the number of tasks whose series are exported, in total and per framework.
+// Once exported, a task keeps its series until it finishes. Tasks over the limit
+// are dropped or aggregated and reconsidered every time their slave is queried, so
+// that they take the place of tasks that have finished. A nil limiter exports
+// every task.
+type taskLimiter struct {
+	config   *Config
+	counts   map[taskCount]int
+	exported prometheus.Gauge
+	limited  *prometheus.GaugeVec
+	mutex    *sync.Mutex
+	overflow *prometheus.CounterVec
+	tasks    map[string]map[string]limitedTask
+	total    int
+}
+
+func (l *taskLimiter) Describe(ch chan<- *prometheus.Desc) {
+	l.exported.Describe(ch)
+	l.limited.Describe(ch)
+	l.overflow.Describe(ch)
+}
+
+func (l *taskLimiter) Collect(ch chan<- prometheus.Metric) {
+	l.exported.Collect(ch)
+	l.limited.Collect(ch)
+	l.overflow.Collect(ch)
+}
+
+// Decides what happens to the series of a task of the given framework on the
+// given slave.
+func (l *taskLimiter) admit(slave Slave, executorId string, framework string) taskLimitState {
+	if l == nil {
+		return taskExported
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	tasks, ok := l.tasks[slave.key()]
+	if ok == false {
+		tasks = make(map[string]limitedTask)
+		l.tasks[slave.key()] = tasks
+	}
+
+	task, known := tasks[executorId]
+	if known && task.state == taskExported {
+		return taskExported
+	}
+
+	total, perFramework, overflow := l.config.taskLimit()
+
+	state := taskExported
+	if (total > 0 && l.total >= total) || (perFramework > 0 && l.counts[taskCount{framework, taskExported}] >= perFramework) {
+		state = taskDropped
+		if overflow == overflowAggregate {
+			state = taskAggregated
+		}
+	}
+
+	if known {
+		l.count(task, -1)
+	} else if state != taskExported {
+		l.overflow.WithLabelValues(state.String()).Inc()
+	}
+
+	task = limitedTask{framework, state}
+	tasks[executorId] = task
+	l.count(task, 1)
+
+	return state
+}
+
+// Forgets the tasks of the slave that are not available anymore.
+func (l *taskLimiter) retain(slave Slave, available map[string]struct{}) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for executorId, task := range l.tasks[slave.key()] {
+		if _, ok := available[executorId]; ok == false {
+			l.count(task, -1)
+			delete(l.tasks[slave.key()], executorId)
+		}
+	}
+}
+
+// Forgets all tasks of a slave that is not queried anymore.
+func (l *taskLimiter) releaseSlave(slave Slave) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, task := range l.tasks[slave.key()] {
+		l.count(task, -1)
+	}
+
+	delete(l.tasks, slave.key())
+}
+
+// Must be called with the mutex held. Frameworks without tasks over the limit are
+// removed from the gauge.
+func (l *taskLimiter) count(task limitedTask, delta int) {
+	key := taskCount{task.framework, task.state}
+
+	l.counts[key] = l.counts[key] + delta
+	if l.counts[key] <= 0 {
+		delete(l.counts, key)
+	}
+
+	if task.state == taskExported {
+		l.total = l.total + delta
+		l.exported.Set(float64(l.total))
+		return
+	}
+
+	if count, ok := l.counts[key]; ok {
+		l.limited.WithLabelValues(task.state.String(), task.framework).Set(float64(count))
+	} else {
+		l.limited.DeleteLabelValues(task.state.String(), task.framework)
+	}
+}
+
+func newTaskLimiter(conf *Config) *taskLimiter {
+	return &taskLimiter{
+		config: conf,
+		counts: make(map[taskCount]int),
+		exported: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Help:      "Tasks whose series are exported",
+				Name:      "exported_tasks",
+				Namespace: namespace,
+				Subsystem: "exporter",
+			}),
+		limited: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Help:      "Running tasks whose series are dropped or aggregated because they exceed a limit",
+				Name:      "limited_tasks",
+				Namespace: namespace,
+				Subsystem: "exporter",
+			},
+			[]string{"action", "framework"}),
+		mutex: &sync.Mutex{},
+		overflow: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Help:      "Tasks whose series have been dropped or aggregated because they exceeded a limit when they were first seen",
+				Name:      "limited_tasks_total",
+				Namespace: namespace,
+				Subsystem: "exporter",
+			},
+			[]string{"action"}),
+		tasks: make(map[string]map[string]limitedTask),
+	}
+}
+
+// A task over the limit with its statistics of the current query of its slave.
+type aggregatedTask struct {
+	key         string
+	labelValues []string
+	sample      taskSample
+}
+
+// Statistics of the tasks on a slave that are over the limit, summed up per
+// framework into series whose executor, task and task labels are "other", so that
+// tasks with unique names share one series. Counters of tasks that leave a series,
+// because they finished or are exported on their own, keep their last value in
+// the sum - the summed counters never go down, which Prometheus would take for a
+// reset. A series is removed once it has no tasks left.
+type taskAggregates struct {
+	series map[string]*taskAggregate
+	// Number of leading label values that belong to the task
+	taskLabels int
+}
+
+type taskAggregate struct {
+	// Last counter values of the tasks that left the series, by the index of the
+	// statistic
+	departed    []*float64
+	labelValues []string
+	// Statistics of the tasks in the series by the key of the task and the index
+	// of the statistic
+	tasks map[string][]*float64
+	// Sums by the index of the statistic, nil if no task reported it
+	values []*float64
+}
+
+// Replaces the tasks of the series with the given ones. Returns the label values
+// of the series that have no tasks anymore.
+func (a *taskAggregates) update(tasks []aggregatedTask) [][]string {
+	current := make(map[string]map[string][]*float64)
+	labelValues := make(map[string][]string)
+
+	for _, task := range tasks {
+		values := a.labelValues(task.labelValues)
+		key := strings.Join(values, "\x00")
+
+		if _, ok := current[key]; ok == false {
+			current[key] = make(map[string][]*float64)
+			labelValues[key] = values
+		}
+
+		current[key][task.key] = aggregatedValues(task.sample)
+	}
+
+	removed := [][]string{}
+
+	for key, aggregate := range a.series {
+		for taskKey, values := range aggregate.tasks {
+			if _, ok := current[key][taskKey]; ok {
+				continue
+			}
+
+			for i, value := range values {
+				if value != nil && taskStatistics[i].valueType == prometheus.CounterValue {
+					aggregate.departed[i] = addValue(aggregate.departed[i], *value)
+				}
+			}
+		}
+
+		if _, ok := current[key]; ok == false {
+			delete(a.series, key)
+			removed = append(removed, aggregate.labelValues)
+		}
+	}
+
+	for key, taskValues := range current {
+		aggregate, ok := a.series[key]
+		if ok == false {
+			aggregate = &taskAggregate{
+				departed:    make([]*float64, len(taskStatistics)),
+				labelValues: labelValues[key],
+			}
+
+			a.series[key] = aggregate
+		}
+
+		aggregate.tasks = taskValues
+		aggregate.values = make([]*float64, len(taskStatistics))
+
+		for i, value := range aggregate.departed {
+			if value != nil {
+				aggregate.values[i] = addValue(nil, *value)
+			}
+		}
+
+		for _, values := range taskValues {
+			for i, value := range values {
+				if value != nil {
+					aggregate.values[i] = addValue(aggregate.values[i], *value)
+				}
+			}
+		}
+	}
+
+	return removed
+}
+
+// Keeps the framework and replaces the other label values of the task.
+func (a *taskAggregates) labelValues(values []string) []string {
+	aggregated := append([]string{}, values...)
+
+	for i := 0; i < a.taskLabels && i < len(aggregated); i++ {
+		if i != 1 {
+			aggregated[i] = aggregatedLabelValue
+		}
+	}
+
+	return aggregated
+}
+
+func newTaskAggregates(conf *Config) *taskAggregates {
+	return &taskAggregates{
+		series:     make(map[string]*taskAggregate),
+		taskLabels: len(taskLabelNames(conf)),
+	}
+}
+
+// Statistics of a task that can be summed up - all but the ratios.
+func aggregatedValues(sample taskSample) []*float64 {
+	values := make([]*float64, len(taskStatistics))
+
+	for i, statistic := range taskStatistics {
+		if statistic.ratio {
+			continue
+		}
+
+		if value, ok := statistic.value(sample); ok {
+			values[i] = &value
+		}
+	}
+
+	return values
+}
+
+func addValue(sum *float64, value float64) *float64 {
+	if sum != nil {
+		value = value + *sum
+	}
+
+	return &value
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func limitedTasks(t *testing.T, l *taskLimiter, state taskLimitState, framework string) float64 {
+	out := &dto.Metric{}
+	require.NoError(t, l.limited.WithLabelValues(state.String(), framework).Write(out))
+
+	return out.GetGauge().GetValue()
+}
+
+func TestTaskLimiter(t *testing.T) {
+	conf := &Config{MesosFrameworkTaskLimit: 2, MesosTaskLimit: 3, MesosTaskLimitOverflow: overflowDrop}
+	l := newTaskLimiter(conf)
+
+	slave1 := Slave{Pid: "slave(1)@10.0.0.1:5051"}
+	slave2 := Slave{Pid: "slave(1)@10.0.0.2:5051"}
+
+	require.Equal(t, taskExported, l.admit(slave1, "spark.1", "spark"))
+	require.Equal(t, taskExported, l.admit(slave2, "spark.2", "spark"))
+
+	// Over the limit of the framework
+	require.Equal(t, taskDropped, l.admit(slave1, "spark.3", "spark"))
+	require.Equal(t, taskExported, l.admit(slave1, "chronos.1", "chronos"))
+
+	// Over the total limit
+	require.Equal(t, taskDropped, l.admit(slave2, "chronos.2", "chronos"))
+
+	// Exported tasks keep their series
+	require.Equal(t, taskExported, l.admit(slave1, "spark.1", "spark"))
+
+	require.Equal(t, 3.0, gaugeValue(t, l.exported))
+	require.Equal(t, 1.0, limitedTasks(t, l, taskDropped, "spark"))
+	require.Equal(t, 1.0, limitedTasks(t, l, taskDropped, "chronos"))
+
+	// A finished task makes room for a task over the limit
+	l.retain(slave1, map[string]struct{}{"chronos.1": {}, "spark.3": {}})
+
+	require.Equal(t, taskExported, l.admit(slave1, "spark.3", "spark"))
+	require.Equal(t, 3.0, gaugeValue(t, l.exported))
+
+	// Tasks over the limit are aggregated after a reload
+	conf.MesosTaskLimitOverflow = overflowAggregate
+
+	require.Equal(t, taskAggregated, l.admit(slave2, "chronos.2", "chronos"))
+	require.Equal(t, 0.0, limitedTasks(t, l, taskDropped, "chronos"))
+	require.Equal(t, 1.0, limitedTasks(t, l, taskAggregated, "chronos"))
+
+	l.releaseSlave(slave2)
+
+	require.Equal(t, 2.0, gaugeValue(t, l.exported))
+	require.Equal(t, 0.0, limitedTasks(t, l, taskAggregated, "chronos"))
+
+	// Every task is only counted once when it exceeds a limit
+	out := &dto.Metric{}
+	require.NoError(t, l.overflow.WithLabelValues(taskDropped.String()).Write(out))
+	require.Equal(t, 2.0, out.GetCounter().GetValue())
+
+	// Without limits everything is exported
+	var none *taskLimiter
+
+	require.Equal(t, taskExported, none.admit(slave1, "spark.4", "spark"))
+}
+
+func TestTaskAggregates(t *testing.T) {
+	aggregates := newTaskAggregates(&Config{MesosTaskLabelNames: []string{"team"}})
+
+	value := func(aggregate *taskAggregate, name string) *float64 {
+		for i, statistic := range taskStatistics {
+			if statistic.name == name {
+				return aggregate.values[i]
+			}
+		}
+
+		return nil
+	}
+
+	// Tasks with unique names and labels of the same framework share one series
+	tasks := []aggregatedTask{}
+	for i := 0; i < 10; i++ {
+		tasks = append(tasks, aggregatedTask{
+			key:         fmt.Sprintf("spark.%d", i),
+			labelValues: []string{fmt.Sprintf("spark.%d", i), "spark", fmt.Sprintf("job-%d", i), fmt.Sprintf("team-%d", i)},
+			sample: taskSample{
+				resources:  Resources{Cpus: 1, Mem: 128},
+				statistics: Statistics{CpusUserTimeSecs: 10, MemRssBytes: 64 * megabyte},
+			},
+		})
+	}
+
+	tasks = append(tasks, aggregatedTask{
+		key:         "chronos.1",
+		labelValues: []string{"chronos.1", "chronos", "backup", "infra"},
+		sample:      taskSample{resources: Resources{Cpus: 2}},
+	})
+
+	require.Len(t, aggregates.update(tasks), 0)
+	require.Len(t, aggregates.series, 2)
+
+	var spark *taskAggregate
+	for _, aggregate := range aggregates.series {
+		if aggregate.labelValues[1] == "spark" {
+			spark = aggregate
+		}
+	}
+
+	require.Equal(t, []string{aggregatedLabelValue, "spark", aggregatedLabelValue, aggregatedLabelValue}, spark.labelValues)
+	require.Equal(t, 100.0, *value(spark, "cpus_user_time_seconds"))
+	require.Equal(t, 10.0, *value(spark, "requested_cpus"))
+	require.Equal(t, 640.0*megabyte, *value(spark, "mem_rss_bytes"))
+
+	// Ratios are not summed up, disk usage was not reported
+	require.Nil(t, value(spark, "mem_utilisation_ratio"))
+	require.Nil(t, value(spark, "disk_used_bytes"))
+
+	// Counters keep the last values of tasks that left, gauges don't
+	remaining := tasks[0]
+	remaining.sample.statistics.CpusUserTimeSecs = 15
+
+	require.Equal(t, [][]string{{aggregatedLabelValue, "chronos", aggregatedLabelValue, aggregatedLabelValue}}, aggregates.update([]aggregatedTask{remaining}))
+	require.Len(t, aggregates.series, 1)
+
+	require.Equal(t, 105.0, *value(spark, "cpus_user_time_seconds"))
+	require.Equal(t, 1.0, *value(spark, "requested_cpus"))
+	require.Equal(t, 64.0*megabyte, *value(spark, "mem_rss_bytes"))
+
+	// A series without tasks is removed
+	require.Len(t, aggregates.update(nil), 1)
+	require.Len(t, aggregates.series, 0)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Which tasks the executors on a slave run and which containers the tasks run in,
+// as reported by the slave itself.
+type slaveState struct {
+	containers map[string]string
+	executors  map[taskKey][]string
+}
+
+func (s *slaveState) add(frameworkId string, executorId string, taskId string, containerIds []string) {
+	executor := taskKey{frameworkId, executorId}
+	s.executors[executor] = append(s.executors[executor], taskId)
+
+	for _, containerId := range containerIds {
+		s.containers[containerId] = taskId
+	}
+}
+
+func newSlaveState() *slaveState {
+	return &slaveState{
+		containers: make(map[string]string),
+		executors:  make(map[taskKey][]string),
+	}
+}
+
+type legacySlaveState struct {
+	Frameworks []struct {
+		Executors []struct {
+			Id    string
+			Tasks []struct {
+				Id       string
+				Statuses []v1TaskStatus
+			}
+		}
+		Id string
+	}
+}
+
+func retrieveSlaveState(c *http.Client, state *slaveState, url string) error {
+	resp, err := c.Get(url)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{resp.StatusCode, fmt.Sprintf("Unexpected status code %d from '%s'", resp.StatusCode, url)}
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var res legacySlaveState
+
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return err
+	}
+
+	for _, framework := range res.Frameworks {
+		for _, executor := range framework.Executors {
+			for _, task := range executor.Tasks {
+				containerIds := []string{}
+				for _, status := range task.Statuses {
+					if status.ContainerStatus.ContainerId != nil {
+						containerIds = append(containerIds, status.ContainerStatus.ContainerId.Value)
+					}
+				}
+
+				state.add(framework.Id, executor.Id, task.Id, containerIds)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Finds the tasks that statistics reported by a slave belong to. Tasks are looked
+// up by the ID of their executor in the frameworks reported by the Mesos master.
+// The slave itself is only asked if that is not enough, e.g. for the containers of
+// tasks in a task group or for tasks the master did not report yet - at most once
+// per resolver.
+type taskResolver struct {
+	api        *mesosApi
+	client     *http.Client
+	frameworks *frameworkRegistry
+	slave      Slave
+	state      *slaveState
+	stateErr   error
+}
+
+// Returns the task of the statistics. The statistics of an executor that runs
+// several tasks, but does not report them separately, belong to all of them - they
+// are combined into one task.
+func (r *taskResolver) resolve(item MonitoredTask) (Framework, Task, bool) {
+	if item.Nested {
+		taskId, ok := r.slaveState().containers[item.ContainerId]
+		if ok == false {
+			return Framework{}, Task{}, false
+		}
+
+		return r.frameworks.LookupTask(item.FrameworkId, taskId)
+	}
+
+	framework, tasks, ok := r.frameworks.Lookup(item.FrameworkId, item.ExecutorId)
+	if ok == false {
+		return Framework{}, Task{}, false
+	}
+
+	if len(tasks) == 0 {
+		for _, taskId := range r.slaveState().executors[taskKey{item.FrameworkId, item.ExecutorId}] {
+			if _, task, ok := r.frameworks.LookupTask(item.FrameworkId, taskId); ok {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+
+	if len(tasks) == 0 {
+		return Framework{}, Task{}, false
+	}
+
+	return framework, combineTasks(tasks), true
+}
+
+// The state of the slave is queried the first time it is needed. A slave that
+// can't be queried is treated as if it ran no tasks.
+func (r *taskResolver) slaveState() *slaveState {
+	if r.state != nil {
+		return r.state
+	}
+
+	r.state = newSlaveState()
+
+	r.stateErr = r.api.slaveState(r.client, r.state, r.slave)
+	if r.stateErr != nil {
+		log.Warnf("Unable to retrieve the state of slave '%s': %s", r.slave.Pid, r.stateErr)
+	}
+
+	return r.state
+}
+
+// Whether the slave itself reported that it runs no task for statistics that could
+// not be resolved. Those won't ever be resolved, unlike the tasks of frameworks the
+// master did not report yet. Only known if the state of the slave has been queried.
+func (r *taskResolver) unknown(item MonitoredTask) bool {
+	if r.state == nil || r.stateErr != nil {
+		return false
+	}
+
+	if item.Nested {
+		_, ok := r.state.containers[item.ContainerId]
+		return ok == false
+	}
+
+	if _, _, ok := r.frameworks.Lookup(item.FrameworkId, item.ExecutorId); ok == false {
+		return false
+	}
+
+	return len(r.state.executors[taskKey{item.FrameworkId, item.ExecutorId}]) == 0
+}
+
+func newTaskResolver(c *http.Client, api *mesosApi, frameworks *frameworkRegistry, slave Slave) *taskResolver {
+	return &taskResolver{
+		api:        api,
+		client:     c,
+		frameworks: frameworks,
+		slave:      slave,
+	}
+}
+
+// Combines the tasks of an executor into one that is named after all of them,
+// requested their resources together and has the labels they have in common.
+func combineTasks(tasks []Task) Task {
+	if len(tasks) == 1 {
+		return tasks[0]
+	}
+
+	sorted := append([]Task{}, tasks...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	combined := Task{
+		ExecutorId: sorted[0].ExecutorId,
+		SlaveId:    sorted[0].SlaveId,
+		State:      sorted[0].State,
+	}
+
+	ids := []string{}
+	names := []string{}
+	ports := []string{}
+
+	for i, task := range sorted {
+		ids = append(ids, task.Id)
+		names = append(names, task.Name)
+
+		combined.Resources.Cpus = combined.Resources.Cpus + task.Resources.Cpus
+		combined.Resources.Disk = combined.Resources.Disk + task.Resources.Disk
+		combined.Resources.Gpus = combined.Resources.Gpus + task.Resources.Gpus
+		combined.Resources.Mem = combined.Resources.Mem + task.Resources.Mem
+
+		if ranges := strings.Trim(task.Resources.Ports, "[]"); ranges != "" {
+			ports = append(ports, ranges)
+		}
+
+		if i == 0 {
+			combined.Labels = task.Labels
+			continue
+		}
+
+		combined.Labels = commonLabels(combined.Labels, task.Labels)
+	}
+
+	combined.Id = strings.Join(ids, ",")
+	combined.Name = strings.Join(names, ",")
+
+	if len(ports) > 0 {
+		combined.Resources.Ports = "[" + strings.Join(ports, ", ") + "]"
+	}
+
+	return combined
+}
+
+func commonLabels(a []Label, b []Label) []Label {
+	common := []Label{}
+
+	for _, label := range a {
+		for _, other := range b {
+			if label == other {
+				common = append(common, label)
+				break
+			}
+		}
+	}
+
+	return common
+}
+
+// Drops the statistics of executors whose tasks are reported in containers of
+// their own. They include the statistics of the tasks, which would otherwise be
+// exported twice.
+func withoutParentContainers(items []MonitoredTask) []MonitoredTask {
+	parents := make(map[string]struct{})
+	for _, item := range items {
+		if item.Nested {
+			parents[item.FrameworkId+"/"+item.ExecutorId] = struct{}{}
+		}
+	}
+
+	if len(parents) == 0 {
+		return items
+	}
+
+	kept := []MonitoredTask{}
+	for _, item := range items {
+		if _, ok := parents[item.FrameworkId+"/"+item.ExecutorId]; ok && item.Nested == false {
+			continue
+		}
+
+		kept = append(kept, item)
+	}
+
+	return kept
+}
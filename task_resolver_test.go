@@ -0,0 +1,148 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// State of an agent running a task group of the default executor and an Aurora
+// task that the master has not reported yet.
+var fakeAgentV1StateResponses = map[string]string{
+	"GET_STATE": `{
+		"type": "GET_STATE",
+		"get_state": {
+			"get_tasks": {
+				"launched_tasks": [
+					{
+						"task_id": {"value": "app.1"},
+						"framework_id": {"value": "fw1"},
+						"executor_id": {"value": "default.1"},
+						"statuses": [{"container_status": {"container_id": {"value": "c2", "parent": {"value": "c1"}}}}]
+					},
+					{
+						"task_id": {"value": "sidecar.1"},
+						"framework_id": {"value": "fw1"},
+						"executor_id": {"value": "default.1"},
+						"statuses": [{"container_status": {"container_id": {"value": "c3", "parent": {"value": "c1"}}}}]
+					},
+					{
+						"task_id": {"value": "api.1"},
+						"framework_id": {"value": "fw2"},
+						"executor_id": {"value": "thermos-api.1"},
+						"statuses": [{"container_status": {"container_id": {"value": "c4"}}}]
+					}
+				]
+			}
+		}
+	}`,
+}
+
+func TestTaskResolver(t *testing.T) {
+	legacyCount := 0
+
+	ts := newFakeMesosServer(t, "1.6.0", fakeAgentV1StateResponses, "", &legacyCount)
+	defer ts.Close()
+
+	slaveUrl, _ := url.Parse(ts.URL)
+
+	frameworks := NewFrameworkRegistry(0)
+	frameworks.Replace([]Framework{
+		{Id: "fw1", Name: "pods", Tasks: []Task{
+			{ExecutorId: "default.1", Id: "sidecar.1", Labels: []Label{{"team", "infra"}}, Name: "sidecar", Resources: Resources{Cpus: 0.1, Ports: "[31000-31000]"}},
+			{ExecutorId: "default.1", Id: "app.1", Labels: []Label{{"team", "infra"}, {"tier", "web"}}, Name: "app", Resources: Resources{Cpus: 1, Ports: "[31001-31002]"}},
+		}},
+		{Id: "fw2", Name: "aurora", Tasks: []Task{{ExecutorId: "thermos-api.1", Id: "api.1", Name: "api"}}},
+		{Id: "fw3", Name: "marathon", Tasks: []Task{{Id: "web.1", Name: "web"}}},
+	})
+
+	api := newMesosApi(&Config{MesosApiVersion: apiVersionV1, MesosSlaveScheme: "http"})
+	slave := Slave{Pid: "slave(1)@" + slaveUrl.Host}
+
+	// Tasks of the command executor and custom executors are known to the master
+	r := newTaskResolver(&http.Client{}, api, frameworks, slave)
+
+	_, task, ok := r.resolve(MonitoredTask{ExecutorId: "web.1", FrameworkId: "fw3"})
+	require.True(t, ok)
+	require.Equal(t, "web", task.Name)
+
+	_, task, ok = r.resolve(MonitoredTask{ExecutorId: "thermos-api.1", FrameworkId: "fw2"})
+	require.True(t, ok)
+	require.Equal(t, "api", task.Name)
+
+	// Tasks of a task group that are reported together are combined
+	_, task, ok = r.resolve(MonitoredTask{ExecutorId: "default.1", FrameworkId: "fw1"})
+	require.True(t, ok)
+	require.Equal(t, "app,sidecar", task.Name)
+	require.Equal(t, 1.1, task.Resources.Cpus)
+	require.Equal(t, "[31001-31002, 31000-31000]", task.Resources.Ports)
+	require.Equal(t, []Label{{"team", "infra"}}, task.Labels)
+
+	require.Nil(t, r.state)
+
+	// Containers of single tasks are looked up in the state of the slave
+	framework, task, ok := r.resolve(MonitoredTask{ContainerId: "c3", ExecutorId: "default.1", FrameworkId: "fw1", Nested: true})
+	require.True(t, ok)
+	require.Equal(t, "pods", framework.Name)
+	require.Equal(t, "sidecar", task.Name)
+
+	_, _, ok = r.resolve(MonitoredTask{ContainerId: "c9", ExecutorId: "default.1", FrameworkId: "fw1", Nested: true})
+	require.False(t, ok)
+
+	// Executors that the master does not know yet are looked up in the state of the slave
+	frameworks.Replace([]Framework{
+		{Id: "fw2", Name: "aurora", Tasks: []Task{{Id: "api.1", Name: "api"}}},
+	})
+
+	r = newTaskResolver(&http.Client{}, api, frameworks, slave)
+
+	_, task, ok = r.resolve(MonitoredTask{ExecutorId: "thermos-api.1", FrameworkId: "fw2"})
+	require.True(t, ok)
+	require.Equal(t, "api", task.Name)
+
+	_, _, ok = r.resolve(MonitoredTask{ExecutorId: "web.1", FrameworkId: "fw3"})
+	require.False(t, ok)
+}
+
+func TestRetrieveSlaveState(t *testing.T) {
+	legacyCount := 0
+
+	ts := newFakeMesosServer(t, "1.0.0", nil, `{
+		"frameworks": [{
+			"id": "fw1",
+			"executors": [{
+				"id": "default.1",
+				"tasks": [
+					{"id": "app.1", "statuses": [{"container_status": {"container_id": {"value": "c2", "parent": {"value": "c1"}}}}]},
+					{"id": "sidecar.1", "statuses": []}
+				]
+			}]
+		}]
+	}`, &legacyCount)
+	defer ts.Close()
+
+	slaveUrl, _ := url.Parse(ts.URL)
+
+	state := newSlaveState()
+	require.NoError(t, newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}).slaveState(&http.Client{}, state, Slave{Pid: "slave(1)@" + slaveUrl.Host}))
+
+	require.Equal(t, map[string]string{"c2": "app.1"}, state.containers)
+	require.Equal(t, []string{"app.1", "sidecar.1"}, state.executors[taskKey{"fw1", "default.1"}])
+	require.Equal(t, 1, legacyCount)
+}
+
+func TestWithoutParentContainers(t *testing.T) {
+	items := []MonitoredTask{
+		{ContainerId: "c1", ExecutorId: "default.1", FrameworkId: "fw1"},
+		{ContainerId: "c2", ExecutorId: "default.1", FrameworkId: "fw1", Nested: true},
+		{ContainerId: "c3", ExecutorId: "default.1", FrameworkId: "fw1", Nested: true},
+		{ContainerId: "c4", ExecutorId: "default.1", FrameworkId: "fw2"},
+	}
+
+	kept := withoutParentContainers(items)
+
+	require.Len(t, kept, 3)
+	require.Equal(t, "default.1/c2", kept[0].key())
+	require.Equal(t, "default.1", kept[2].key())
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/samuel/go-zookeeper/zk"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	zkLeaderPrefix   = "json.info_"
+	zkRetryInterval  = 1 * time.Second
+	zkSessionTimeout = 10 * time.Second
+)
+
+// The part of a MasterInfo that Mesos masters publish in ZooKeeper.
+type MasterInfo struct {
+	Address struct {
+		Hostname string
+		Ip       string
+		Port     int
+	}
+	Hostname string
+	Id       string
+	Pid      string
+	Version  string
+}
+
+// Address used to query the HTTP API of the master.
+func (mi *MasterInfo) address() (string, error) {
+	parts := strings.Split(mi.Pid, "@")
+	if len(parts) == 2 && parts[1] != "" {
+		return parts[1], nil
+	}
+
+	if mi.Address.Ip != "" && mi.Address.Port != 0 {
+		return fmt.Sprintf("%s:%d", mi.Address.Ip, mi.Address.Port), nil
+	}
+
+	return "", fmt.Errorf("Unable to determine address of Mesos master '%s'", mi.Id)
+}
+
+// Forwards log messages of the ZooKeeper client to logrus.
+type zkLogger struct{}
+
+func (l zkLogger) Printf(format string, args ...interface{}) {
+	log.Debugf(format, args...)
+}
+
+// Watches the znodes that Mesos masters create in ZooKeeper and keeps track of the
+// current leader and all other masters.
+type zkMasterDetector struct {
+	changes chan struct{}
+	conn    *zk.Conn
+	leader  *url.URL
+	masters []*url.URL
+	mutex   *sync.Mutex
+	path    string
+	scheme  string
+	stop    chan struct{}
+}
+
+// Returns the URL of the current leader or nil if no leader has been elected.
+func (d *zkMasterDetector) Leader() *url.URL {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.leader
+}
+
+// Returns the URLs of all masters registered in ZooKeeper, the leader first.
+func (d *zkMasterDetector) Masters() []*url.URL {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return append([]*url.URL{}, d.masters...)
+}
+
+func (d *zkMasterDetector) Stop() {
+	close(d.stop)
+	d.conn.Close()
+}
+
+func (d *zkMasterDetector) run() {
+	for {
+		err := d.watch()
+		if err == nil {
+			return
+		}
+
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+
+		log.Errorf("Unable to detect Mesos master leader in ZooKeeper: %s", err)
+
+		select {
+		case <-d.stop:
+			return
+		case <-time.After(zkRetryInterval):
+		}
+	}
+}
+
+// Reads the masters from ZooKeeper and updates them every time the children of the
+// path change. Returns nil only when the detector is stopped.
+func (d *zkMasterDetector) watch() error {
+	for {
+		children, _, events, err := d.conn.ChildrenW(d.path)
+		if err != nil {
+			return err
+		}
+
+		leader, masters, err := d.findMasters(children)
+		if err != nil {
+			return err
+		}
+
+		d.mutex.Lock()
+		d.masters = masters
+		d.mutex.Unlock()
+
+		d.setLeader(leader)
+
+		select {
+		case <-d.stop:
+			return nil
+		case <-events:
+		}
+	}
+}
+
+// The master that created the znode with the lowest sequence number is the leader.
+// Masters whose znode can't be read are left out, only the leader has to be valid.
+func (d *zkMasterDetector) findMasters(children []string) (*url.URL, []*url.URL, error) {
+	var candidates []string
+
+	for _, child := range children {
+		if strings.HasPrefix(child, zkLeaderPrefix) {
+			candidates = append(candidates, child)
+		}
+	}
+
+	sort.Strings(candidates)
+
+	var leader *url.URL
+	masters := []*url.URL{}
+
+	for i, candidate := range candidates {
+		master, err := d.readMaster(candidate)
+		if err == zk.ErrNoNode {
+			// The master went away in the meantime - the watch fires again
+			continue
+		}
+
+		if err != nil && i == 0 {
+			return nil, nil, err
+		}
+
+		if err != nil {
+			log.Warnf("Unable to read Mesos master '%s' from ZooKeeper: %s", candidate, err)
+			continue
+		}
+
+		if i == 0 {
+			leader = master
+		}
+
+		masters = append(masters, master)
+	}
+
+	return leader, masters, nil
+}
+
+// Reads the URL of a master from its znode.
+func (d *zkMasterDetector) readMaster(node string) (*url.URL, error) {
+	data, _, err := d.conn.Get(d.path + "/" + node)
+	if err != nil {
+		return nil, err
+	}
+
+	var info MasterInfo
+
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	address, err := info.address()
+	if err != nil {
+		return nil, err
+	}
+
+	return &url.URL{Scheme: d.scheme, Host: address}, nil
+}
+
+func (d *zkMasterDetector) setLeader(leader *url.URL) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if leader == nil && d.leader == nil {
+		return
+	}
+
+	if leader != nil && d.leader != nil && *leader == *d.leader {
+		return
+	}
+
+	if leader == nil {
+		log.Warn("No Mesos master leader registered in ZooKeeper")
+	} else {
+		log.Infof("Detected '%s' as the current Mesos master leader in ZooKeeper", leader)
+	}
+
+	d.leader = leader
+
+	// Notify without blocking - a pending notification is enough
+	select {
+	case d.changes <- struct{}{}:
+	default:
+	}
+}
+
+// Leaders are queried with the given URL scheme.
+func newZkMasterDetector(servers []string, path string, scheme string) (*zkMasterDetector, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("No ZooKeeper servers configured")
+	}
+
+	conn, _, err := zk.Connect(servers, zkSessionTimeout, zk.WithLogger(zkLogger{}))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &zkMasterDetector{
+		changes: make(chan struct{}, 1),
+		conn:    conn,
+		mutex:   &sync.Mutex{},
+		path:    path,
+		scheme:  scheme,
+		stop:    make(chan struct{}),
+	}
+
+	go d.run()
+
+	return d, nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+)
+
+const (
+	zkOpClose        = -11
+	zkOpGetData      = 4
+	zkOpPing         = 11
+	zkOpGetChildren2 = 12
+	zkOpSetWatches   = 101
+
+	zkErrNoNode = -101
+
+	zkEventNodeChildrenChanged = 4
+	zkStateSyncConnected       = 3
+)
+
+// An in-process ZooKeeper server that implements just enough of the protocol for
+// the master detector: reading data and children of nodes and child watches.
+type fakeZkServer struct {
+	listener net.Listener
+	mutex    *sync.Mutex
+	nodes    map[string][]byte
+	watches  map[string][]net.Conn
+	zxid     int64
+}
+
+func newFakeZkServer(t *testing.T) *fakeZkServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &fakeZkServer{
+		listener: l,
+		mutex:    &sync.Mutex{},
+		nodes:    make(map[string][]byte),
+		watches:  make(map[string][]net.Conn),
+	}
+
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeZkServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeZkServer) Close() {
+	s.listener.Close()
+}
+
+// Creates or deletes (data == nil) a node and triggers the child watch of its parent.
+func (s *fakeZkServer) Set(p string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if data == nil {
+		delete(s.nodes, p)
+	} else {
+		s.nodes[p] = data
+	}
+
+	s.zxid = s.zxid + 1
+
+	parent := path.Dir(p)
+	for _, conn := range s.watches[parent] {
+		w := &zkWriter{}
+		w.int32(-1)
+		w.int64(-1)
+		w.int32(0)
+		w.int32(zkEventNodeChildrenChanged)
+		w.int32(zkStateSyncConnected)
+		w.string(parent)
+		w.send(conn)
+	}
+
+	delete(s.watches, parent)
+}
+
+func (s *fakeZkServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeZkServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	// Connect request
+	if _, err := readZkPacket(conn); err != nil {
+		return
+	}
+
+	w := &zkWriter{}
+	w.int32(0)
+	w.int32(10000)
+	w.int64(1)
+	w.bytes(make([]byte, 16))
+	w.send(conn)
+
+	for {
+		packet, err := readZkPacket(conn)
+		if err != nil {
+			return
+		}
+
+		r := &zkReader{buf: packet}
+		xid := r.int32()
+		op := r.int32()
+
+		s.mutex.Lock()
+
+		w := &zkWriter{}
+		w.int32(xid)
+		w.int64(s.zxid)
+
+		switch op {
+		case zkOpPing, zkOpSetWatches:
+			w.int32(0)
+		case zkOpClose:
+			w.int32(0)
+			w.send(conn)
+			s.mutex.Unlock()
+			return
+		case zkOpGetData:
+			p := r.string()
+			data, ok := s.nodes[p]
+			if ok == false {
+				w.int32(zkErrNoNode)
+				break
+			}
+
+			w.int32(0)
+			w.bytes(data)
+			w.stat()
+		case zkOpGetChildren2:
+			p := r.string()
+			watch := r.bool()
+
+			children := []string{}
+			for node := range s.nodes {
+				if path.Dir(node) == p {
+					children = append(children, path.Base(node))
+				}
+			}
+			sort.Strings(children)
+
+			if watch {
+				s.watches[p] = append(s.watches[p], conn)
+			}
+
+			w.int32(0)
+			w.int32(int32(len(children)))
+			for _, child := range children {
+				w.string(child)
+			}
+			w.stat()
+		default:
+			w.int32(-6)
+		}
+
+		w.send(conn)
+		s.mutex.Unlock()
+	}
+}
+
+func readZkPacket(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+
+	packet := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(conn, packet); err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+type zkReader struct {
+	buf []byte
+}
+
+func (r *zkReader) bool() bool {
+	v := r.buf[0] != 0
+	r.buf = r.buf[1:]
+	return v
+}
+
+func (r *zkReader) int32() int32 {
+	v := int32(binary.BigEndian.Uint32(r.buf))
+	r.buf = r.buf[4:]
+	return v
+}
+
+func (r *zkReader) string() string {
+	l := int(r.int32())
+	v := string(r.buf[:l])
+	r.buf = r.buf[l:]
+	return v
+}
+
+type zkWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *zkWriter) bytes(v []byte) {
+	w.int32(int32(len(v)))
+	w.buf.Write(v)
+}
+
+func (w *zkWriter) int32(v int32) {
+	binary.Write(&w.buf, binary.BigEndian, v)
+}
+
+func (w *zkWriter) int64(v int64) {
+	binary.Write(&w.buf, binary.BigEndian, v)
+}
+
+func (w *zkWriter) send(conn net.Conn) {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(w.buf.Len()))
+	conn.Write(append(header, w.buf.Bytes()...))
+}
+
+// All fields of a Stat are zero
+func (w *zkWriter) stat() {
+	w.buf.Write(make([]byte, 68))
+}
+
+func (w *zkWriter) string(v string) {
+	w.bytes([]byte(v))
+}
+
+func masterInfo(pid string) []byte {
+	data, _ := json.Marshal(MasterInfo{Pid: pid})
+	return data
+}
+
+func TestParseZkUrl(t *testing.T) {
+	servers, p, err := parseZkUrl("zk://host1:2181,host2/mesos/")
+
+	require.NoError(t, err)
+	require.Equal(t, []string{"host1:2181", "host2:2181"}, servers)
+	require.Equal(t, "/mesos", p)
+
+	_, _, err = parseZkUrl("zk://host1:2181")
+	require.Error(t, err)
+}
+
+func TestZkMasterDetectorFollowsLeader(t *testing.T) {
+	s := newFakeZkServer(t)
+	defer s.Close()
+
+	s.Set("/mesos/log_replicas", []byte{})
+	s.Set("/mesos/json.info_0000000002", masterInfo("master@10.0.0.2:5050"))
+	s.Set("/mesos/json.info_0000000001", masterInfo("master@10.0.0.1:5050"))
+
+	d, err := newZkMasterDetector([]string{s.Addr()}, "/mesos", "http")
+	require.NoError(t, err)
+	defer d.Stop()
+
+	<-d.changes
+	require.Equal(t, "http://10.0.0.1:5050", d.Leader().String())
+	require.Equal(t, []string{"http://10.0.0.1:5050", "http://10.0.0.2:5050"}, urlStrings(d.Masters()))
+
+	// A master that can't be read is left out unless it leads
+	s.Set("/mesos/json.info_0000000003", []byte("invalid"))
+	s.Set("/mesos/json.info_0000000004", masterInfo("master@10.0.0.4:5050"))
+
+	require.True(t, waitFor(func() bool { return len(d.Masters()) == 3 }))
+	require.Equal(t, []string{"http://10.0.0.1:5050", "http://10.0.0.2:5050", "http://10.0.0.4:5050"}, urlStrings(d.Masters()))
+
+	s.Set("/mesos/json.info_0000000003", nil)
+	s.Set("/mesos/json.info_0000000004", nil)
+
+	// The leader goes away and the next master in line takes over
+	s.Set("/mesos/json.info_0000000001", nil)
+
+	<-d.changes
+	require.Equal(t, "http://10.0.0.2:5050", d.Leader().String())
+	require.Equal(t, []string{"http://10.0.0.2:5050"}, urlStrings(d.Masters()))
+
+	// No master is left
+	s.Set("/mesos/json.info_0000000002", nil)
+
+	<-d.changes
+	require.Nil(t, d.Leader())
+	require.Len(t, d.Masters(), 0)
+}
+
+func urlStrings(urls []*url.URL) []string {
+	values := []string{}
+	for _, u := range urls {
+		values = append(values, u.String())
+	}
+
+	return values
+}
+
+func TestRetrieveDetectedMasterState(t *testing.T) {
+	var masterUrl *url.URL
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		master := Master{Leader: "master@" + masterUrl.Host}
+
+		data, _ := json.Marshal(master)
+
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	masterUrl, _ = url.Parse(ts.URL)
+
+	s := newFakeZkServer(t)
+	defer s.Close()
+
+	d, err := newZkMasterDetector([]string{s.Addr()}, "/mesos", "http")
+	require.NoError(t, err)
+	defer d.Stop()
+
+	m := masterPoller{
+		api:        newMesosApi(&Config{MesosApiVersion: apiVersionV0, MesosSlaveScheme: "http"}),
+		config:     &Config{},
+		detector:   d,
+		httpClient: &http.Client{},
+	}
+
+	_, err = m.retrieveCurrentMasterState(context.Background())
+	require.Error(t, err)
+
+	s.Set("/mesos/json.info_0000000001", masterInfo("master@"+masterUrl.Host))
+	<-d.changes
+
+	res, err := m.retrieveCurrentMasterState(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "master@"+masterUrl.Host, res.Leader)
+	require.Equal(t, masterUrl.Host, m.currentMesosMaster.Host)
+}